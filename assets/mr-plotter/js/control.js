@@ -377,6 +377,9 @@ function executePermalink(self, args, set_streams_only) {
     for (i = 0; i < streams.length; i++) {
         stream = streams[i];
         colors.push(stream.color);
+        if (stream.version !== undefined) {
+            self.idata.pinnedVersions[typeof stream.stream == 'object' ? stream.stream.uuid : stream.stream] = stream.version;
+        }
         if (typeof stream.stream == 'object') {
             streamObjs[i] = stream.stream;
             if (stream.selected) {
@@ -382,7 +382,7 @@ function getNearestDataPoint(self, xmillis, xnanos, data, uuid, pw) {
             endTime[1] -= 1000000;
             endTime[0] += 1;
         }
-        var req = [uuid, s3ui.timeToStr(currentPoint), s3ui.timeToStr(endTime), 0];
+        var req = [s3ui.streamQueryID(self, uuid), s3ui.timeToStr(currentPoint), s3ui.timeToStr(endTime), 0];
         self.requester.makeDataRequest(req, function (data) {
                 cacheExactTime(self, currentPoint, data);
             });
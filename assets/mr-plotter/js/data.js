@@ -298,6 +298,15 @@ function ensureData(self, uuid, pointwidthexp, startTime, endTime, callback, cac
 /* Gets all the points where the middle of the interval is between queryStart
    and queryEnd, including queryStart but not queryEnd. HALFPWNANOS should be
    Math.pow(2, pointwidthexp - 1) - 1. */
+/* Returns the identifier to use for the stream UUID in a data request, which
+   includes the version of the stream if it is pinned. */
+function streamQueryID(self, uuid) {
+    if (self.idata.pinnedVersions.hasOwnProperty(uuid)) {
+        return uuid + "@" + self.idata.pinnedVersions[uuid];
+    }
+    return uuid;
+}
+
 function makeDataRequest(self, uuid, queryStart, queryEnd, pointwidthexp, halfpwnanos, callback, caching) {
     /* queryStart and queryEnd are the start and end of the query I want,
     in terms of the midpoints of the intervals I get back; the real archiver
@@ -306,7 +315,7 @@ function makeDataRequest(self, uuid, queryStart, queryEnd, pointwidthexp, halfpw
     var halfpwmillisStart = Math.floor(halfpwnanos / 1000000);
     var halfpwnanosStart = halfpwnanos - (1000000 * halfpwmillisStart);
     halfpwnanosStart = (1000000 + halfpwnanosStart).toString().slice(1);
-    var req = [uuid, (queryStart + halfpwmillisStart) + halfpwnanosStart, (queryEnd + halfpwmillisStart) + halfpwnanosStart, pointwidthexp];
+    var req = [streamQueryID(self, uuid), (queryStart + halfpwmillisStart) + halfpwnanosStart, (queryEnd + halfpwmillisStart) + halfpwnanosStart, pointwidthexp];
     if (caching) {
         self.requester.makeDataRequest(req, function (data) {
                 callback(data, queryStart, queryEnd);
@@ -670,3 +679,4 @@ s3ui.shouldPollBrackets = shouldPollBrackets;
 s3ui.getPWExponent = getPWExponent;
 s3ui.ensureData = ensureData;
 s3ui.limitMemory = limitMemory;
+s3ui.streamQueryID = streamQueryID;
@@ -25,6 +25,7 @@ function init_frontend(self) {
     self.idata.labelFormatter = new AnyTime.Converter({format: self.idata.dateFormat, utcFormatOffsetImposed: 0});
     self.idata.makeColorMenu = s3ui.makeMenuMaker();
     self.idata.streamSettings = {}; // Stores the stream settings chosen in the legend (maps uuid to a setting object)
+    self.idata.pinnedVersions = {}; // Maps uuid to the version of the stream to display, for streams restored from a permalink with a pinned version
     self.idata.selectedStreamsBuffer = self.idata.selectedStreams; // Streams that have been selected and are displayed in the legend
     self.idata.streamMessages = {}; // Maps a stream's uuid to a 2-element array containing 1) an object mapping importances (ints) to messages and 2) the importance of the current message being displayed
 
@@ -276,7 +277,13 @@ function createPermalink(self, return_raw_document) {
     var domain = self.idata.oldXScale.domain();
     var streams = [];
     var permalink = {
-            streams: self.idata.selectedStreams.map(function (d) { return { stream: coerce_stream(d), color: self.idata.streamSettings[d.uuid].color, selected: self.idata.showingDensity == d.uuid }; }),
+            streams: self.idata.selectedStreams.map(function (d) {
+                    var stream = { stream: coerce_stream(d), color: self.idata.streamSettings[d.uuid].color, selected: self.idata.showingDensity == d.uuid };
+                    if (self.idata.pinnedVersions.hasOwnProperty(d.uuid)) {
+                        stream.version = self.idata.pinnedVersions[d.uuid];
+                    }
+                    return stream;
+                }),
             resetStart: Number(self.idata.oldStartDate.toString() + '000000'),
             resetEnd: Number(self.idata.oldEndDate.toString() + '000000'),
             tz: self.idata.oldTimezone,
@@ -540,6 +547,7 @@ function buildCSVMenu(self) {
 
 function prepareCSVDownloadOptions(self, streams, settingsObj, domain, pwe, graphExport) {
     streamUUIDs = streams.filter(function (x) { return settingsObj.hasOwnProperty(x.uuid); }).map(function (x) { return x.uuid; });
+    var selectedTimezone = getSelectedTimezone(self);
     var dataJSON = {
         "StartTime": domain[0] - self.idata.offset,
         "EndTime": domain[1] - self.idata.offset,
@@ -550,8 +558,13 @@ function prepareCSVDownloadOptions(self, streams, settingsObj, domain, pwe, grap
         "WindowUnit": self.find(".csv-unit-current").innerHTML,
         "UnitofTime": "ms",
         "PointWidth": pwe,
+        "Timezone": selectedTimezone[0],
+        "DST": selectedTimezone[1],
         "_token": self.requester.getToken()
     };
+    if (streamUUIDs.some(function (x) { return self.idata.pinnedVersions.hasOwnProperty(x); })) {
+        dataJSON.Versions = streamUUIDs.map(function (x) { return self.idata.pinnedVersions[x] || 0; });
+    }
     return dataJSON;
 }
 
@@ -578,23 +591,19 @@ function login(self) {
     setLoginText(self, "Logging in...");
     self.requester.makeLoginRequest(username, password, function (token) {
             setButtonEnabled($loginButton, true);
-            if (token === "" || token === " ") {
-                if (token === "") {
-                    loginmessage.innerHTML = "Invalid username or password";
-                } else {
-                    loginmessage.innerHTML = "Server error"
-                }
-                restoreLoginText(self);
-                $loginButton.dropdown("toggle");
+            loggedin(self, username, token);
+            s3ui.updateStreamTree(self);
+            var $loginList = $(loginElem.querySelector(".loginList"));
+            $loginList.find(".loginstate-start").hide();
+            $loginList.find(".loginstate-loggedin").show();
+        }, function (jqXHR) {
+            if (jqXHR.status === 401) {
+                loginmessage.innerHTML = "Invalid username or password";
+            } else if (jqXHR.status !== 0) {
+                loginmessage.innerHTML = "Server error";
             } else {
-                loggedin(self, username, token);
-                s3ui.updateStreamTree(self);
-                var $loginList = $(loginElem.querySelector(".loginList"));
-                $loginList.find(".loginstate-start").hide();
-                $loginList.find(".loginstate-loggedin").show();
+                loginmessage.innerHTML = "Could not contact server; check Internet connection";
             }
-        }, function (error) {
-            loginmessage.innerHTML = "Could not contact server; check Internet connection";
             restoreLoginText(self);
             setButtonEnabled($loginButton, true);
             $loginButton.dropdown("toggle");
@@ -19,7 +19,32 @@
  */
 
 s3ui.USE_WEBSOCKETS = false;
-s3ui.ERROR_INVALID_TOKEN = "Invalid token";
+s3ui.ERROR_INVALID_TOKEN = "invalid_token";
+
+/* The server reports errors as a JSON document of the form
+   {"error": {"code": <code>, "message": <message>}}. Returns the error object,
+   or null if ERRORTEXT is not an error response. */
+s3ui.parseError = function (errorText) {
+        var parsed;
+        try {
+            parsed = JSON.parse(errorText);
+        } catch (err) {
+            return null;
+        }
+        if (parsed === null || typeof(parsed) !== "object" || typeof(parsed.error) !== "object") {
+            return null;
+        }
+        return parsed.error;
+    };
+
+/* Returns a human-readable description of the error in ERRORTEXT. */
+s3ui.errorMessage = function (errorText) {
+        var error = s3ui.parseError(errorText);
+        if (error === null) {
+            return errorText;
+        }
+        return error.message;
+    };
 
 function DataConn(url) {
     this.ws = new WebSocket(url);
@@ -36,8 +61,11 @@ function DataConn(url) {
             if (self.currResponse === null) {
                 self.currResponse = response;
             } else {
-                var callback = self.openMessages[response];
-                delete self.openMessages[response];
+                /* The tag may be followed by the version of the stream that
+                   was served, separated by a comma. */
+                var tag = response.split(",")[0];
+                var callback = self.openMessages[tag];
+                delete self.openMessages[tag];
                 var response = self.currResponse;
                 self.currResponse = null;
                 callback(response);
@@ -93,7 +121,8 @@ Requester.prototype.getToken = function (token) {
     };
 
 Requester.prototype.checkErrorInvalidToken = function (errorText) {
-        if (errorText == s3ui.ERROR_INVALID_TOKEN) {
+        var error = s3ui.parseError(errorText);
+        if (error !== null && error.code == s3ui.ERROR_INVALID_TOKEN) {
             s3ui.sessionExpired(this.plotter);
         }
     };
@@ -106,7 +135,7 @@ Requester.prototype.makeLoginRequest = function (username, password, success_cal
             data: loginjsonstr,
             success: success_callback,
             dataType: "text",
-            error: error_callback = undefined ? function () {} : error_callback
+            error: error_callback === undefined ? function () {} : error_callback
         });
     };
 
@@ -117,7 +146,7 @@ Requester.prototype.makeLogoffRequest = function (success_callback, error_callba
             data: this.token,
             success: success_callback,
             dataType: "text",
-            error: error_callback = undefined ? function () {} : error_callback
+            error: error_callback === undefined ? function () {} : error_callback
         });
     };
 
@@ -128,7 +157,7 @@ Requester.prototype.makeCheckTokenRequest = function (token, success_callback, e
             data: token,
             success: success_callback,
             dataType: "text",
-            error: error_callback = undefined ? function () {} : error_callback
+            error: error_callback === undefined ? function () {} : error_callback
         });
     };
 
@@ -140,7 +169,7 @@ Requester.prototype.makeChangePasswordRequest = function (old_password, new_pass
             data: changepwjsonstr,
             success: success_callback,
             dataType: "text",
-            error: error_callback = undefined ? function () {} : error_callback
+            error: error_callback === undefined ? function () {} : error_callback
         });
     };
 
@@ -237,7 +266,7 @@ Requester.prototype.makePermalinkInsertRequest = function (permalinkObj, success
                 data: permalinkjsonstr,
                 success: success_callback,
                 dataType: "text",
-                error: error_callback = undefined ? function () {} : error_callback
+                error: error_callback === undefined ? function () {} : error_callback
             });
     };
 
@@ -248,7 +277,7 @@ Requester.prototype.makePermalinkRetrievalRequest = function (permalinkStr, succ
                 data: {id: permalinkStr},
                 success: success_callback,
                 dataType: "text",
-                error: error_callback = undefined ? function () {} : error_callback
+                error: error_callback === undefined ? function () {} : error_callback
             });
     };
 
@@ -292,7 +321,7 @@ Requester.prototype.makeDataRequest = function (request, callback) {
                             delete self.reqs[request_str];
                             self.checkErrorInvalidToken(jqXHR.responseText);
                             for (var i = 0; i < callback_list.length; i++) {
-                                callback_list[i](jqXHR.responseText);
+                                callback_list[i](s3ui.errorMessage(jqXHR.responseText));
                             }
                         }
                 });
@@ -322,8 +351,93 @@ Requester.prototype.makeBracketRequest = function (request, callback) {
                     dataType: "json",
                     error: function (jqXHR) {
                             self.checkErrorInvalidToken(jqXHR.responseText);
-                            callback(jqXHR.responseText);
+                            callback(s3ui.errorMessage(jqXHR.responseText));
                         }
                 });
         }
     };
+
+/** Requests the time ranges of stream UUID that changed between FROMVERSION and
+    TOVERSION (0 for the latest version), at a granularity of 2^RESOLUTION
+    nanoseconds. */
+Requester.prototype.makeChangesRequest = function (uuid, fromversion, toversion, resolution, callback) {
+        var request_str = [uuid, fromversion, toversion, resolution, this.token].join(',');
+        var self = this;
+        return $.ajax({
+                type: "POST",
+                url: location.protocol + "//" + this.backend + "/changes",
+                data: request_str,
+                success: callback,
+                dataType: "json",
+                error: function (jqXHR) {
+                        self.checkErrorInvalidToken(jqXHR.responseText);
+                        callback(s3ui.errorMessage(jqXHR.responseText));
+                    }
+            });
+    };
+
+/** Subscribes to live updates to the tail of stream UUID at point width
+    exponent PW. CALLBACK is called with each update pushed by the server: an
+    object with the new "Version", the new "Bracket", and the "Points" after
+    the previous bracket (in the same format as a data response). If the
+    subscription fails, CALLBACK is called with the error message instead, and
+    the subscription is dropped. If the connection is lost, it is reopened and
+    every subscription is renewed. */
+Requester.prototype.subscribe = function (uuid, pw, callback) {
+        var self = this;
+        if (this.subcallbacks === undefined) {
+            this.subcallbacks = {};
+        }
+        if (this.subconn === undefined) {
+            this.subconn = new WebSocket("wss://" + this.backend + "/subscribews");
+            this.subconn.onmessage = function (message) {
+                    var update = JSON.parse(message.data);
+                    var key = update.UUID + "," + update.PointWidth;
+                    var cb = self.subcallbacks[key];
+                    if (update.error !== undefined) {
+                        self.checkErrorInvalidToken(message.data);
+                        if (cb !== undefined) {
+                            delete self.subcallbacks[key];
+                            cb(update.error.message);
+                        } else {
+                            console.log("Subscription error: " + update.error.message);
+                        }
+                        return;
+                    }
+                    if (cb !== undefined) {
+                        cb(update);
+                    }
+                };
+            this.subconn.onclose = function () {
+                    self.subconn = undefined;
+                    setTimeout(function () {
+                            var callbacks = self.subcallbacks;
+                            self.subcallbacks = {};
+                            for (var key in callbacks) {
+                                var parts = key.split(",");
+                                self.subscribe(parts[0], parts[1], callbacks[key]);
+                            }
+                        }, 1000);
+                };
+        }
+        if (this.subconn.readyState === WebSocket.CONNECTING) {
+            setTimeout(function () { self.subscribe(uuid, pw, callback); }, 1000);
+            return;
+        }
+        this.subcallbacks[uuid + "," + pw] = callback;
+        if (this.subconn.readyState === WebSocket.OPEN) {
+            this.subconn.send(["subscribe", uuid, pw, this.token].join(','));
+        }
+        /* Otherwise, the connection is closing, and the subscription is made
+           when it is reopened. */
+    };
+
+Requester.prototype.unsubscribe = function (uuid, pw) {
+        if (this.subcallbacks !== undefined) {
+            delete this.subcallbacks[uuid + "," + pw];
+        }
+        if (this.subconn === undefined || this.subconn.readyState !== WebSocket.OPEN) {
+            return;
+        }
+        this.subconn.send(["unsubscribe", uuid, pw].join(','));
+    };
@@ -99,9 +99,6 @@ s3ui.exec_permalink = function (self, link_id) {
                 var permalinkJSON;
                 if (result == undefined) {
                     return;
-                } else if (result == "not found") {
-                    console.log("Server could not retrieve data for permalink " + link_id);
-                    return;
                 }
                 try {
                     permalinkJSON = JSON.parse(result);
@@ -110,6 +107,8 @@ s3ui.exec_permalink = function (self, link_id) {
                     return;
                 }
                 s3ui.executePermalink(self, permalinkJSON);
+            }, function (jqXHR) {
+                console.log("Server could not retrieve data for permalink " + link_id + ": " + s3ui.errorMessage(jqXHR.responseText));
             });
     };
 
@@ -0,0 +1,267 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package csvquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// arrowBatchRows is the number of rows buffered in memory before they are
+// written out as a single record batch (or, for Parquet, a row group).
+const arrowBatchRows = 65536
+
+// recordwriter is satisfied by both the Arrow IPC and the Parquet writers.
+type recordwriter interface {
+	Write(rec array.Record) error
+	Close() error
+}
+
+// arrowsink collects rows into Arrow record batches. The first column is the
+// timestamp; it is followed by the columns of each stream, with the same names
+// as in the CSV header. A stream with no point at a row's time is null in that
+// row.
+type arrowsink struct {
+	mem     memory.Allocator
+	builder *array.RecordBuilder
+	columns []array.Builder
+	width   int
+	rows    int
+
+	// open creates the writer once the schema is known.
+	open   func(schema *arrow.Schema) (recordwriter, error)
+	writer recordwriter
+	closed bool
+}
+
+func (as *arrowsink) writeHeader(buf streambuffer, q *CSVQuery) error {
+	if q.Layout != WideLayout {
+		return errors.New("Only the wide layout is supported for Arrow and Parquet files")
+	}
+	header := buf.getHeaderRow(q.Labels, q.IncludeVersions)
+	types := buf.columnTypes()
+	as.width = len(types)
+
+	fields := make([]arrow.Field, 1, 1+q.numStreams()*as.width)
+	fields[0] = arrow.Field{Name: "Timestamp", Type: arrow.FixedWidthTypes.Timestamp_ns}
+	for i := 0; i != q.numStreams(); i++ {
+		for j, t := range types {
+			fields = append(fields, arrow.Field{Name: header[2+i*as.width+j], Type: t, Nullable: true})
+		}
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	var err error
+	as.writer, err = as.open(schema)
+	if err != nil {
+		return err
+	}
+
+	as.builder = array.NewRecordBuilder(as.mem, schema)
+	as.columns = make([]array.Builder, len(fields))
+	for i := range fields {
+		as.columns[i] = as.builder.Field(i)
+	}
+	return nil
+}
+
+func (as *arrowsink) beginRow(t int64) {
+	as.columns[0].(*array.TimestampBuilder).Append(arrow.Timestamp(t))
+}
+
+func (as *arrowsink) streamColumns(i int) []array.Builder {
+	offset := 1 + i*as.width
+	return as.columns[offset : offset+as.width]
+}
+
+func (as *arrowsink) writePoint(buf streambuffer, i int) {
+	buf.appendPoint(i, as.streamColumns(i))
+}
+
+func (as *arrowsink) writeEmptyPoint(buf streambuffer, i int) {
+	for _, column := range as.streamColumns(i) {
+		column.AppendNull()
+	}
+}
+
+func (as *arrowsink) endRow() error {
+	as.rows++
+	if as.rows == arrowBatchRows {
+		return as.flush()
+	}
+	return nil
+}
+
+func (as *arrowsink) flush() error {
+	rec := as.builder.NewRecord()
+	defer rec.Release()
+	as.rows = 0
+	return as.writer.Write(rec)
+}
+
+func (as *arrowsink) finish() error {
+	if as.rows != 0 {
+		if err := as.flush(); err != nil {
+			return err
+		}
+	}
+	as.closed = true
+	return as.writer.Close()
+}
+
+// close releases the record builder, and closes the writer if the query
+// failed before the sink was finished.
+func (as *arrowsink) close() {
+	if as.builder != nil {
+		as.builder.Release()
+	}
+	if as.writer != nil && !as.closed {
+		as.writer.Close()
+	}
+}
+
+// offsetwriter keeps track of the number of bytes written, so that the Arrow
+// IPC file writer, which asks for its offset in the file, can write to a
+// stream that cannot seek.
+type offsetwriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (ow *offsetwriter) Write(p []byte) (int, error) {
+	n, err := ow.w.Write(p)
+	ow.offset += int64(n)
+	return n, err
+}
+
+func (ow *offsetwriter) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return ow.offset, errors.New("Cannot seek in an Arrow IPC file that is being streamed")
+	}
+	return ow.offset, nil
+}
+
+// parquetNameReplacer replaces the characters that cannot appear in a Parquet
+// column name given to the writer.
+var parquetNameReplacer = strings.NewReplacer(".", "_", ",", "_", "=", "_", "\t", "_")
+
+// parquetwriter writes each record batch as a Parquet row group. Timestamps
+// are written as INT64 columns, in nanoseconds since the Unix epoch, and
+// unsigned integers as INT64 columns annotated as UINT_64. Every column is
+// optional, so that a stream with no point at a row's time is null in that
+// row.
+type parquetwriter struct {
+	w *writer.CSVWriter
+}
+
+func newParquetWriter(schema *arrow.Schema, w io.Writer) (*parquetwriter, error) {
+	fields := schema.Fields()
+	md := make([]string, len(fields))
+	for i, field := range fields {
+		var t string
+		switch field.Type.ID() {
+		case arrow.TIMESTAMP:
+			t = "type=INT64"
+		case arrow.FLOAT64:
+			t = "type=DOUBLE"
+		case arrow.UINT64:
+			// The writer takes a converted type in place of the physical
+			// type, and stores UINT_64 columns as INT64.
+			t = "type=UINT_64"
+		default:
+			return nil, fmt.Errorf("Cannot write a column of type %s to a Parquet file", field.Type.Name())
+		}
+		md[i] = fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", parquetNameReplacer.Replace(field.Name), t)
+	}
+	pw, err := writer.NewCSVWriterFromWriter(md, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetwriter{w: pw}, nil
+}
+
+func (pw *parquetwriter) Write(rec array.Record) error {
+	columns := rec.Columns()
+	for r := 0; r != int(rec.NumRows()); r++ {
+		// The writer keeps each row until the row group is flushed, so a
+		// new slice is needed for every row.
+		row := make([]interface{}, len(columns))
+		for c, column := range columns {
+			if column.IsNull(r) {
+				continue
+			}
+			switch column := column.(type) {
+			case *array.Timestamp:
+				row[c] = int64(column.Value(r))
+			case *array.Float64:
+				row[c] = column.Value(r)
+			case *array.Uint64:
+				row[c] = int64(column.Value(r))
+			}
+		}
+		if err := pw.w.Write(row); err != nil {
+			return err
+		}
+	}
+	return pw.w.Flush(true)
+}
+
+func (pw *parquetwriter) Close() error {
+	return pw.w.WriteStop()
+}
+
+// MakeArrowQuery performs a query with the same parameters as a CSV query, and
+// writes the result to the provided writer as an Arrow IPC file.
+func MakeArrowQuery(ctx context.Context, b *btrdb.BTrDB, q *CSVQuery, w io.Writer) error {
+	mem := memory.NewGoAllocator()
+	as := &arrowsink{
+		mem: mem,
+		open: func(schema *arrow.Schema) (recordwriter, error) {
+			return ipc.NewFileWriter(&offsetwriter{w: w}, ipc.WithSchema(schema), ipc.WithAllocator(mem))
+		},
+	}
+	defer as.close()
+	return makeQuery(ctx, b, q, as)
+}
+
+// MakeParquetQuery performs a query with the same parameters as a CSV query,
+// and writes the result to the provided writer as a Parquet file.
+func MakeParquetQuery(ctx context.Context, b *btrdb.BTrDB, q *CSVQuery, w io.Writer) error {
+	as := &arrowsink{
+		mem: memory.NewGoAllocator(),
+		open: func(schema *arrow.Schema) (recordwriter, error) {
+			return newParquetWriter(schema, w)
+		},
+	}
+	defer as.close()
+	return makeQuery(ctx, b, q, as)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package csvquery
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// TestParquetRoundTrip writes a record batch in which one stream has no point
+// at some times, and checks that the file reads back with the same values and
+// with nulls where there are no points.
+func TestParquetRoundTrip(t *testing.T) {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "Timestamp", Type: arrow.FixedWidthTypes.Timestamp_ns},
+		{Name: "a.b (Mean)", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "a.b (Count)", Type: arrow.PrimitiveTypes.Uint64, Nullable: true},
+	}, nil)
+
+	builder := array.NewRecordBuilder(memory.NewGoAllocator(), schema)
+	defer builder.Release()
+	times := []int64{10, 20, 30}
+	means := []float64{1.5, 0, -2.25}
+	counts := []uint64{4, 0, 1 << 40}
+	valid := []bool{true, false, true}
+	for _, tm := range times {
+		builder.Field(0).(*array.TimestampBuilder).Append(arrow.Timestamp(tm))
+	}
+	builder.Field(1).(*array.Float64Builder).AppendValues(means, valid)
+	builder.Field(2).(*array.Uint64Builder).AppendValues(counts, valid)
+	rec := builder.NewRecord()
+	defer rec.Release()
+
+	var buf bytes.Buffer
+	pw, err := newParquetWriter(schema, &buf)
+	if err != nil {
+		t.Fatalf("newParquetWriter: %v", err)
+	}
+	if err = pw.Write(rec); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err = pw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	file, err := buffer.NewBufferFile(buf.Bytes())
+	if err != nil {
+		t.Fatalf("NewBufferFile: %v", err)
+	}
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		t.Fatalf("NewParquetColumnReader: %v", err)
+	}
+	defer pr.ReadStop()
+	if n := pr.GetNumRows(); n != int64(len(times)) {
+		t.Fatalf("Read %d rows; expected %d", n, len(times))
+	}
+
+	elements := pr.Footer.GetSchema()[1:]
+	if len(elements) != len(schema.Fields()) {
+		t.Fatalf("Read %d columns; expected %d", len(elements), len(schema.Fields()))
+	}
+	for i, element := range elements {
+		if element.GetRepetitionType() != parquet.FieldRepetitionType_OPTIONAL {
+			t.Errorf("Column %d is not optional", i)
+		}
+	}
+	if elements[1].GetType() != parquet.Type_DOUBLE {
+		t.Errorf("Mean column has type %v; expected DOUBLE", elements[1].GetType())
+	}
+	if elements[2].GetType() != parquet.Type_INT64 || elements[2].GetConvertedType() != parquet.ConvertedType_UINT_64 {
+		t.Errorf("Count column has type %v (%v); expected INT64 (UINT_64)", elements[2].GetType(), elements[2].GetConvertedType())
+	}
+
+	for c := range elements {
+		values, _, dls, err := pr.ReadColumnByIndex(int64(c), int64(len(times)))
+		if err != nil {
+			t.Fatalf("ReadColumnByIndex(%d): %v", c, err)
+		}
+		if len(values) != len(times) {
+			t.Fatalf("Read %d values from column %d; expected %d", len(values), c, len(times))
+		}
+		for r := range times {
+			if c != 0 && !valid[r] {
+				if dls[r] != 0 || values[r] != nil {
+					t.Errorf("Row %d of column %d is %v; expected null", r, c, values[r])
+				}
+				continue
+			}
+			var expected interface{}
+			switch c {
+			case 0:
+				expected = times[r]
+			case 1:
+				expected = means[r]
+			case 2:
+				expected = int64(counts[r])
+			}
+			if values[r] != expected {
+				t.Errorf("Row %d of column %d is %v; expected %v", r, c, values[r], expected)
+			}
+		}
+	}
+}
@@ -26,9 +26,16 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"strconv"
 	"time"
 
 	btrdb "gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/BTrDB/mr-plotter/derived"
+	"github.com/BTrDB/mr-plotter/transform"
 )
 
 const (
@@ -43,6 +50,54 @@ const (
 	RawQuery
 )
 
+const (
+	// ShortestFormat formats each value with the fewest digits necessary to
+	// represent it exactly.
+	ShortestFormat = iota
+
+	// ScientificFormat formats each value in scientific notation, with
+	// Precision digits after the decimal point, or with the fewest digits
+	// necessary to represent it exactly if Precision is negative.
+	ScientificFormat
+
+	// FixedFormat formats each value without an exponent, with Precision
+	// digits after the decimal point.
+	FixedFormat
+)
+
+const (
+	// WideLayout writes one row for each distinct time, with a group of
+	// columns for each stream.
+	WideLayout = iota
+
+	// LongLayout writes one row for each point of each stream, with a column
+	// identifying the stream.
+	LongLayout
+)
+
+const (
+	// DefaultTimeFormat formats each timestamp as date and time of day, to
+	// the nanosecond, without a timezone offset.
+	DefaultTimeFormat = iota
+
+	// RFC3339TimeFormat formats each timestamp according to RFC 3339, with
+	// as many fractional digits as necessary.
+	RFC3339TimeFormat
+
+	// ISOTimeFormat formats each timestamp according to ISO 8601, to the
+	// nanosecond, with a timezone offset.
+	ISOTimeFormat
+
+	// ExcelTimeFormat formats each timestamp as an Excel serial date: the
+	// number of days since midnight on December 30, 1899, in Location.
+	ExcelTimeFormat
+)
+
+/* Days from the Excel epoch (December 30, 1899) to the Unix epoch. */
+const excelEpochOffsetDays = 25569
+
+const nanosecondsPerDay int64 = 24 * 60 * 60 * 1000000000
+
 // CSVQuery stores the parameters for a CSV query.
 type CSVQuery struct {
 	// QueryType should be one of AlignedWindowsQuery, WindowsQuery, or
@@ -73,12 +128,121 @@ type CSVQuery struct {
 	// Defaults to 0 (most recent version) for all streams if nil.
 	Versions []uint64
 
-	// Labels contains the name to use for each stream in the output CSV file.
+	// Transforms, if not nil, contains the transform to apply to the points
+	// of each stream in Streams, or nil for no transform.
+	Transforms []*transform.Transform
+
+	// Derived is a slice of derived streams to query. They are written after
+	// the streams in Streams, and their version is always 0.
+	Derived []*derived.Stream
+
+	// Labels contains the name to use for each stream in the output CSV file,
+	// including the derived streams.
 	Labels []string
 
 	// IncludeVersions specifies whether the version number of each stream
 	// should be included in the CSV header.
 	IncludeVersions bool
+
+	// NumberFormat should be one of ShortestFormat, ScientificFormat, or
+	// FixedFormat. It specifies how values are formatted in the CSV file.
+	NumberFormat int
+
+	// Precision is the number of digits after the decimal point for
+	// ScientificFormat and FixedFormat. It is ignored for ShortestFormat.
+	Precision int
+
+	// Location is the timezone in which human-readable timestamps are
+	// written. Defaults to UTC if nil.
+	Location *time.Location
+
+	// TimeFormat should be one of DefaultTimeFormat, RFC3339TimeFormat,
+	// ISOTimeFormat, or ExcelTimeFormat. It specifies how the human-readable
+	// timestamp of each row is formatted in the CSV file.
+	TimeFormat int
+
+	// ResampleInterval, if nonzero, is the spacing, in nanoseconds, of a grid
+	// of times starting at StartTime. Each stream is resampled onto the grid,
+	// so that every row is at a grid time. It may only be used with Raw
+	// Values queries.
+	ResampleInterval uint64
+
+	// Fill should be one of EmptyFill, PreviousFill, LinearFill, or NaNFill.
+	// It specifies the value of a stream at a grid time where it has no
+	// point. It is ignored if ResampleInterval is zero.
+	Fill int
+
+	// Layout should be one of WideLayout or LongLayout. It specifies how the
+	// points of the streams are arranged in the CSV file.
+	Layout int
+
+	// Progress, if not nil, is called with the time of each row after it is
+	// written.
+	Progress func(time int64)
+}
+
+// numberFormatter returns a function that formats values as specified by the
+// query.
+func numberFormatter(q *CSVQuery) (func(float64) string, error) {
+	var verb byte
+	var prec int
+	switch q.NumberFormat {
+	case ShortestFormat:
+		verb, prec = 'g', -1
+	case ScientificFormat:
+		verb, prec = 'e', q.Precision
+		if prec < 0 {
+			prec = -1
+		}
+	case FixedFormat:
+		if q.Precision < 0 {
+			return nil, fmt.Errorf("Invalid precision %d for fixed format", q.Precision)
+		}
+		verb, prec = 'f', q.Precision
+	default:
+		return nil, errors.New("Invalid number format")
+	}
+	return func(value float64) string {
+		return strconv.FormatFloat(value, verb, prec, 64)
+	}, nil
+}
+
+// timeFormatter returns the header for the human-readable time column and a
+// function that formats timestamps as specified by the query.
+func timeFormatter(q *CSVQuery) (string, func(int64) string, error) {
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	var layout string
+	switch q.TimeFormat {
+	case DefaultTimeFormat:
+		layout = "2006-01-02 15:04:05.000000000"
+	case RFC3339TimeFormat:
+		layout = time.RFC3339Nano
+	case ISOTimeFormat:
+		layout = "2006-01-02T15:04:05.000000000-07:00"
+	case ExcelTimeFormat:
+		header := fmt.Sprintf("Excel Serial Date (%s)", loc.String())
+		return header, func(t int64) string {
+			_, offset := time.Unix(0, t).In(loc).Zone()
+			local := t + int64(offset)*int64(time.Second)
+			days := local / nanosecondsPerDay
+			rem := local % nanosecondsPerDay
+			if rem < 0 {
+				days--
+				rem += nanosecondsPerDay
+			}
+			serial := float64(days+excelEpochOffsetDays) + float64(rem)/float64(nanosecondsPerDay)
+			return strconv.FormatFloat(serial, 'f', -1, 64)
+		}, nil
+	default:
+		return "", nil, errors.New("Invalid time format")
+	}
+	header := fmt.Sprintf("Human-Readable Time (%s)", loc.String())
+	return header, func(t int64) string {
+		return time.Unix(0, t).In(loc).Format(layout)
+	}, nil
 }
 
 func setTimeHeaders(row []string) {
@@ -92,9 +256,16 @@ type streambuffer interface {
 	getTime(i int) int64
 	isOpen(i int) bool
 	readPoint(i int) (bool, error)
-	writePoint(i int, row []string)
+	writePoint(i int, row []string, format func(float64) string)
 	writeEmptyPoint(i int, row []string)
 	getHeaderRow(labels []string, includeVersions bool) []string
+
+	// columnTypes and columnNames return the types and names of the columns
+	// for a single stream, in the same order as in the header row.
+	columnTypes() []arrow.DataType
+	columnNames() []string
+	readVersion(i int) uint64
+	appendPoint(i int, columns []array.Builder)
 }
 
 type stabufentry struct {
@@ -103,6 +274,7 @@ type stabufentry struct {
 	errc chan error
 	pt   btrdb.StatPoint
 	open bool
+	tf   *transform.Transform
 }
 
 // stabuffer satisfies the streambuffer interface using statistical points
@@ -122,14 +294,17 @@ func (sb stabuffer) readPoint(i int) (bool, error) {
 		err := <-sb[i].errc
 		return sb[i].open, err
 	}
+	if sb[i].tf != nil {
+		sb[i].pt = sb[i].tf.ApplyStatPoint(sb[i].pt)
+	}
 	return sb[i].open, nil
 }
 
-func (sb stabuffer) writePoint(i int, row []string) {
+func (sb stabuffer) writePoint(i int, row []string, format func(float64) string) {
 	offset := 2 + (i << 2)
-	row[offset+0] = fmt.Sprintf("%f", sb[i].pt.Min)
-	row[offset+1] = fmt.Sprintf("%f", sb[i].pt.Mean)
-	row[offset+2] = fmt.Sprintf("%f", sb[i].pt.Max)
+	row[offset+0] = format(sb[i].pt.Min)
+	row[offset+1] = format(sb[i].pt.Mean)
+	row[offset+2] = format(sb[i].pt.Max)
 	row[offset+3] = fmt.Sprintf("%d", sb[i].pt.Count)
 }
 
@@ -141,6 +316,25 @@ func (sb stabuffer) writeEmptyPoint(i int, row []string) {
 	row[offset+3] = ""
 }
 
+func (sb stabuffer) columnTypes() []arrow.DataType {
+	return []arrow.DataType{arrow.PrimitiveTypes.Float64, arrow.PrimitiveTypes.Float64, arrow.PrimitiveTypes.Float64, arrow.PrimitiveTypes.Uint64}
+}
+
+func (sb stabuffer) columnNames() []string {
+	return []string{"Min", "Mean", "Max", "Count"}
+}
+
+func (sb stabuffer) readVersion(i int) uint64 {
+	return <-sb[i].verc
+}
+
+func (sb stabuffer) appendPoint(i int, columns []array.Builder) {
+	columns[0].(*array.Float64Builder).Append(sb[i].pt.Min)
+	columns[1].(*array.Float64Builder).Append(sb[i].pt.Mean)
+	columns[2].(*array.Float64Builder).Append(sb[i].pt.Max)
+	columns[3].(*array.Uint64Builder).Append(sb[i].pt.Count)
+}
+
 func (sb stabuffer) getHeaderRow(labels []string, includeVersions bool) []string {
 	numcols := 2 + (len(sb) << 2)
 	row := make([]string, numcols, numcols)
@@ -165,6 +359,7 @@ type rawbufentry struct {
 	errc chan error
 	pt   btrdb.RawPoint
 	open bool
+	tf   *transform.Transform
 }
 
 // rawbuffer satisfies the streambuffer interface using raw points
@@ -184,12 +379,15 @@ func (rb rawbuffer) readPoint(i int) (bool, error) {
 		err := <-rb[i].errc
 		return rb[i].open, err
 	}
+	if rb[i].tf != nil {
+		rb[i].pt.Value = rb[i].tf.Apply(rb[i].pt.Value)
+	}
 	return rb[i].open, nil
 }
 
-func (rb rawbuffer) writePoint(i int, row []string) {
+func (rb rawbuffer) writePoint(i int, row []string, format func(float64) string) {
 	offset := 2 + i
-	row[offset] = fmt.Sprintf("%f", rb[i].pt.Value)
+	row[offset] = format(rb[i].pt.Value)
 }
 
 func (rb rawbuffer) writeEmptyPoint(i int, row []string) {
@@ -197,6 +395,22 @@ func (rb rawbuffer) writeEmptyPoint(i int, row []string) {
 	row[offset] = ""
 }
 
+func (rb rawbuffer) columnTypes() []arrow.DataType {
+	return []arrow.DataType{arrow.PrimitiveTypes.Float64}
+}
+
+func (rb rawbuffer) columnNames() []string {
+	return []string{"Value"}
+}
+
+func (rb rawbuffer) readVersion(i int) uint64 {
+	return <-rb[i].verc
+}
+
+func (rb rawbuffer) appendPoint(i int, columns []array.Builder) {
+	columns[0].(*array.Float64Builder).Append(rb[i].pt.Value)
+}
+
 func (rb rawbuffer) getHeaderRow(labels []string, includeVersions bool) []string {
 	numcols := 2 + len(rb)
 	row := make([]string, numcols, numcols)
@@ -212,12 +426,179 @@ func (rb rawbuffer) getHeaderRow(labels []string, includeVersions bool) []string
 	return row
 }
 
+// rowsink consumes the rows produced by merging the streams in a query.
+type rowsink interface {
+	writeHeader(buf streambuffer, q *CSVQuery) error
+	beginRow(time int64)
+	writePoint(buf streambuffer, i int)
+	writeEmptyPoint(buf streambuffer, i int)
+	endRow() error
+	finish() error
+}
+
+// csvsink writes each row to a CSV file.
+type csvsink struct {
+	w          *csv.Writer
+	row        []string
+	format     func(float64) string
+	formatTime func(int64) string
+}
+
+func (cs *csvsink) writeHeader(buf streambuffer, q *CSVQuery) error {
+	var err error
+	cs.format, err = numberFormatter(q)
+	if err != nil {
+		return err
+	}
+	timeHeader, formatTime, err := timeFormatter(q)
+	if err != nil {
+		return err
+	}
+	cs.formatTime = formatTime
+	cs.row = buf.getHeaderRow(q.Labels, q.IncludeVersions)
+	cs.row[1] = timeHeader
+	return cs.w.Write(cs.row)
+}
+
+func (cs *csvsink) beginRow(t int64) {
+	cs.row[0] = fmt.Sprintf("%d", t)
+	cs.row[1] = cs.formatTime(t)
+}
+
+func (cs *csvsink) writePoint(buf streambuffer, i int) {
+	buf.writePoint(i, cs.row, cs.format)
+}
+
+func (cs *csvsink) writeEmptyPoint(buf streambuffer, i int) {
+	buf.writeEmptyPoint(i, cs.row)
+}
+
+func (cs *csvsink) endRow() error {
+	return cs.w.Write(cs.row)
+}
+
+func (cs *csvsink) finish() error {
+	return nil
+}
+
+// longsink writes a row to a CSV file for each point of each stream.
+type longsink struct {
+	w          *csv.Writer
+	err        error
+	format     func(float64) string
+	formatTime func(int64) string
+
+	// wide is a row in the wide layout, which the stream buffer writes each
+	// point into before it is copied to row.
+	wide     []string
+	row      []string
+	width    int
+	labels   []string
+	uuids    []string
+	versions []string
+}
+
+func (ls *longsink) writeHeader(buf streambuffer, q *CSVQuery) error {
+	var err error
+	ls.format, err = numberFormatter(q)
+	if err != nil {
+		return err
+	}
+	timeHeader, formatTime, err := timeFormatter(q)
+	if err != nil {
+		return err
+	}
+	ls.formatTime = formatTime
+
+	names := buf.columnNames()
+	ls.width = len(names)
+	ls.wide = make([]string, 2+q.numStreams()*ls.width)
+	ls.labels = q.Labels
+
+	/* Derived streams have no UUID, so theirs is left empty. */
+	ls.uuids = make([]string, q.numStreams())
+	for i, s := range q.Streams {
+		ls.uuids[i] = s.UUID().String()
+	}
+
+	ls.row = []string{"Timestamp (ns)", timeHeader, "Stream", "UUID"}
+	if q.IncludeVersions {
+		ls.row = append(ls.row, "Version")
+		ls.versions = make([]string, q.numStreams())
+		for i := range ls.versions {
+			ls.versions[i] = fmt.Sprintf("%d", buf.readVersion(i))
+		}
+	}
+	ls.row = append(ls.row, names...)
+	return ls.w.Write(ls.row)
+}
+
+func (ls *longsink) beginRow(t int64) {
+	ls.row[0] = fmt.Sprintf("%d", t)
+	ls.row[1] = ls.formatTime(t)
+}
+
+func (ls *longsink) writePoint(buf streambuffer, i int) {
+	if ls.err != nil {
+		return
+	}
+	buf.writePoint(i, ls.wide, ls.format)
+	ls.row[2] = ls.labels[i]
+	ls.row[3] = ls.uuids[i]
+	var offset = 4
+	if ls.versions != nil {
+		ls.row[4] = ls.versions[i]
+		offset++
+	}
+	copy(ls.row[offset:], ls.wide[2+i*ls.width:2+(i+1)*ls.width])
+	ls.err = ls.w.Write(ls.row)
+}
+
+/* Streams without a point at a given time are simply omitted. */
+func (ls *longsink) writeEmptyPoint(buf streambuffer, i int) {
+}
+
+func (ls *longsink) endRow() error {
+	return ls.err
+}
+
+func (ls *longsink) finish() error {
+	return nil
+}
+
 // MakeCSVQuery performs a CSV query, and outputs the result using the provided
 // CSV writer.
 func MakeCSVQuery(ctx context.Context, b *btrdb.BTrDB, q *CSVQuery, w *csv.Writer) error {
-	var numstreams = len(q.Streams)
+	switch q.Layout {
+	case WideLayout:
+		return makeQuery(ctx, b, q, &csvsink{w: w})
+	case LongLayout:
+		return makeQuery(ctx, b, q, &longsink{w: w})
+	default:
+		return errors.New("Invalid layout")
+	}
+}
+
+/* Returns the number of streams in the query, including derived streams. */
+func (q *CSVQuery) numStreams() int {
+	return len(q.Streams) + len(q.Derived)
+}
+
+/* Returns the transform for the Ith stream in Streams, or nil if it has none. */
+func (q *CSVQuery) transform(i int) *transform.Transform {
+	if q.Transforms == nil {
+		return nil
+	}
+	return q.Transforms[i]
+}
+
+func makeQuery(ctx context.Context, b *btrdb.BTrDB, q *CSVQuery, sink rowsink) error {
+	var numstreams = q.numStreams()
 	if numstreams != len(q.Labels) {
-		return fmt.Errorf("Got %d streams but %d labels", len(q.Streams), len(q.Labels))
+		return fmt.Errorf("Got %d streams but %d labels", numstreams, len(q.Labels))
+	}
+	if q.Versions != nil && len(q.Versions) != len(q.Streams) {
+		return fmt.Errorf("Got %d streams but %d versions", len(q.Streams), len(q.Versions))
 	}
 
 	var versions = q.Versions
@@ -225,43 +606,75 @@ func MakeCSVQuery(ctx context.Context, b *btrdb.BTrDB, q *CSVQuery, w *csv.Write
 		versions = make([]uint64, numstreams, numstreams)
 	}
 
+	if q.ResampleInterval != 0 {
+		if q.QueryType != RawQuery {
+			return errors.New("Only Raw Values queries can be resampled")
+		}
+		if q.ResampleInterval > math.MaxInt64 {
+			return fmt.Errorf("Invalid resample interval %d", q.ResampleInterval)
+		}
+		switch q.Fill {
+		case EmptyFill, PreviousFill, LinearFill, NaNFill:
+		default:
+			return errors.New("Invalid fill policy")
+		}
+	}
+
 	switch q.QueryType {
 	case AlignedWindowsQuery:
 		var sq stabuffer = make([]stabufentry, numstreams, numstreams)
 		for i, s := range q.Streams {
 			sq[i].stac, sq[i].verc, sq[i].errc = s.AlignedWindows(ctx, q.StartTime, q.EndTime, q.Depth, versions[i])
+			sq[i].tf = q.transform(i)
 		}
-		return createCSV(sq, q, w, true)
+		for i, d := range q.Derived {
+			var j = len(q.Streams) + i
+			sq[j].stac, sq[j].verc, sq[j].errc = d.AlignedWindows(ctx, q.StartTime, q.EndTime, q.Depth)
+		}
+		return mergeStreams(sq, q, sink)
 	case WindowsQuery:
 		var sq stabuffer = make([]stabufentry, numstreams, numstreams)
 		for i, s := range q.Streams {
 			sq[i].stac, sq[i].verc, sq[i].errc = s.Windows(ctx, q.StartTime, q.EndTime, q.WindowSize, q.Depth, versions[i])
+			sq[i].tf = q.transform(i)
+		}
+		for i, d := range q.Derived {
+			var j = len(q.Streams) + i
+			sq[j].stac, sq[j].verc, sq[j].errc = d.Windows(ctx, q.StartTime, q.EndTime, q.WindowSize, q.Depth)
 		}
-		return createCSV(sq, q, w, true)
+		return mergeStreams(sq, q, sink)
 	case RawQuery:
 		var sq rawbuffer = make([]rawbufentry, numstreams, numstreams)
 		for i, s := range q.Streams {
 			sq[i].rawc, sq[i].verc, sq[i].errc = s.RawValues(ctx, q.StartTime, q.EndTime, versions[i])
+			sq[i].tf = q.transform(i)
+		}
+		for i, d := range q.Derived {
+			var j = len(q.Streams) + i
+			sq[j].rawc, sq[j].verc, sq[j].errc = d.RawValues(ctx, q.StartTime, q.EndTime)
+		}
+		if q.ResampleInterval != 0 {
+			return mergeStreams(newGridBuffer(sq, q), q, sink)
 		}
-		return createCSV(sq, q, w, false)
+		return mergeStreams(sq, q, sink)
 	default:
 		return errors.New("Invalid query type")
 	}
 }
 
-func createCSV(buf streambuffer, q *CSVQuery, w *csv.Writer, statistical bool) error {
-	// Buffer for the row of the CSV that we are writing
-	var row = buf.getHeaderRow(q.Labels, q.IncludeVersions)
-
+// mergeStreams merges the points of all streams into rows ordered by time,
+// and passes them to the provided sink.
+func mergeStreams(buf streambuffer, q *CSVQuery, sink rowsink) error {
 	// Write the header row
-	var err = w.Write(row)
+	var err = sink.writeHeader(buf, q)
 	if err != nil {
 		return err
 	}
 
 	var open bool
-	var numopen = len(q.Streams)
-	for i := range q.Streams {
+	var numstreams = q.numStreams()
+	var numopen = numstreams
+	for i := 0; i != numstreams; i++ {
 		open, err = buf.readPoint(i)
 		if !open {
 			numopen--
@@ -274,20 +687,19 @@ func createCSV(buf streambuffer, q *CSVQuery, w *csv.Writer, statistical bool) e
 	for numopen != 0 {
 		// Compute the time of the next row
 		var earliest int64 = math.MaxInt64
-		for i := range q.Streams {
+		for i := 0; i != numstreams; i++ {
 			if buf.isOpen(i) && buf.getTime(i) < earliest {
 				earliest = buf.getTime(i)
 			}
 		}
 
 		// Compute the next row
-		row[0] = fmt.Sprintf("%d", earliest)
-		row[1] = time.Unix(0, earliest).Format("2006-01-02 15:04:05.000000000")
-		for i := range q.Streams {
+		sink.beginRow(earliest)
+		for i := 0; i != numstreams; i++ {
 			if !buf.isOpen(i) {
-				continue
+				sink.writeEmptyPoint(buf, i)
 			} else if buf.getTime(i) == earliest {
-				buf.writePoint(i, row)
+				sink.writePoint(buf, i)
 
 				// We consumed this point, so fetch the next point
 				open, err = buf.readPoint(i)
@@ -298,16 +710,19 @@ func createCSV(buf streambuffer, q *CSVQuery, w *csv.Writer, statistical bool) e
 					}
 				}
 			} else {
-				buf.writeEmptyPoint(i, row)
+				sink.writeEmptyPoint(buf, i)
 			}
 		}
 
 		// Emit the row
-		err = w.Write(row)
+		err = sink.endRow()
 		if err != nil {
-			return nil
+			return err
+		}
+		if q.Progress != nil {
+			q.Progress(earliest)
 		}
 	}
 
-	return nil
+	return sink.finish()
 }
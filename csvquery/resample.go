@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package csvquery
+
+import (
+	"math"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+)
+
+const (
+	// EmptyFill leaves a stream's value empty at a grid time where the
+	// stream has no point.
+	EmptyFill = iota
+
+	// PreviousFill uses the value of the stream's latest point before the
+	// grid time.
+	PreviousFill
+
+	// LinearFill interpolates linearly between the stream's points
+	// immediately before and after the grid time.
+	LinearFill
+
+	// NaNFill writes NaN at a grid time where the stream has no point.
+	NaNFill
+)
+
+type gridentry struct {
+	time    int64
+	value   float64
+	valid   bool
+	open    bool
+	started bool
+
+	prev    float64
+	prevt   int64
+	hasPrev bool
+}
+
+// gridbuffer satisfies the streambuffer interface by resampling the points of
+// a rawbuffer onto a grid of evenly spaced times. A stream has a point at
+// every time on the grid; where the underlying stream has no point at exactly
+// that time, its value is determined by the fill policy, and may be invalid
+// (i.e., empty).
+type gridbuffer struct {
+	raw      rawbuffer
+	entries  []gridentry
+	start    int64
+	end      int64
+	interval int64
+	fill     int
+}
+
+func newGridBuffer(raw rawbuffer, q *CSVQuery) *gridbuffer {
+	return &gridbuffer{
+		raw:      raw,
+		entries:  make([]gridentry, len(raw)),
+		start:    q.StartTime,
+		end:      q.EndTime,
+		interval: int64(q.ResampleInterval),
+		fill:     q.Fill,
+	}
+}
+
+func (gb *gridbuffer) getTime(i int) int64 {
+	return gb.entries[i].time
+}
+
+func (gb *gridbuffer) isOpen(i int) bool {
+	return gb.entries[i].open
+}
+
+func (gb *gridbuffer) readPoint(i int) (bool, error) {
+	var entry = &gb.entries[i]
+	var open bool
+	var err error
+	if entry.started {
+		entry.time += gb.interval
+	} else {
+		/* This is the first grid time, so read the first raw point. */
+		entry.started = true
+		entry.time = gb.start
+		if open, err = gb.raw.readPoint(i); !open && err != nil {
+			return false, err
+		}
+	}
+
+	/* The second condition catches overflow. */
+	entry.open = entry.time < gb.end && entry.time >= gb.start
+	if !entry.open {
+		/* Past the end of the grid; drain the raw points to find out if the
+		   query succeeded. */
+		for gb.raw.isOpen(i) {
+			if open, err = gb.raw.readPoint(i); !open && err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+
+	/* Consume the raw points before this grid time. */
+	for gb.raw.isOpen(i) && gb.raw.getTime(i) < entry.time {
+		entry.prev = gb.raw[i].pt.Value
+		entry.prevt = gb.raw[i].pt.Time
+		entry.hasPrev = true
+		if open, err = gb.raw.readPoint(i); !open && err != nil {
+			return false, err
+		}
+	}
+
+	var hasNext = gb.raw.isOpen(i)
+	if hasNext && gb.raw.getTime(i) == entry.time {
+		entry.value, entry.valid = gb.raw[i].pt.Value, true
+		return true, nil
+	}
+
+	switch gb.fill {
+	case PreviousFill:
+		entry.value, entry.valid = entry.prev, entry.hasPrev
+	case LinearFill:
+		entry.valid = entry.hasPrev && hasNext
+		if entry.valid {
+			var next = gb.raw[i].pt
+			var frac = float64(entry.time-entry.prevt) / float64(next.Time-entry.prevt)
+			entry.value = entry.prev + (next.Value-entry.prev)*frac
+		}
+	case NaNFill:
+		entry.value, entry.valid = math.NaN(), true
+	default:
+		entry.valid = false
+	}
+	return true, nil
+}
+
+func (gb *gridbuffer) writePoint(i int, row []string, format func(float64) string) {
+	if gb.entries[i].valid {
+		row[2+i] = format(gb.entries[i].value)
+	} else {
+		row[2+i] = ""
+	}
+}
+
+func (gb *gridbuffer) writeEmptyPoint(i int, row []string) {
+	row[2+i] = ""
+}
+
+func (gb *gridbuffer) getHeaderRow(labels []string, includeVersions bool) []string {
+	return gb.raw.getHeaderRow(labels, includeVersions)
+}
+
+func (gb *gridbuffer) columnTypes() []arrow.DataType {
+	return gb.raw.columnTypes()
+}
+
+func (gb *gridbuffer) columnNames() []string {
+	return gb.raw.columnNames()
+}
+
+func (gb *gridbuffer) readVersion(i int) uint64 {
+	return gb.raw.readVersion(i)
+}
+
+func (gb *gridbuffer) appendPoint(i int, columns []array.Builder) {
+	if gb.entries[i].valid {
+		columns[0].(*array.Float64Builder).Append(gb.entries[i].value)
+	} else {
+		columns[0].AppendNull()
+	}
+}
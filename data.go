@@ -22,9 +22,12 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net/http"
 	"sync"
 	"sync/atomic"
 
@@ -32,6 +35,7 @@ import (
 
 	ws "github.com/gorilla/websocket"
 	uuid "github.com/pborman/uuid"
+	"github.com/samkumar/reqcache"
 )
 
 const (
@@ -50,19 +54,118 @@ func splitTime(time int64) (millis int64, nanos int32) {
 	return
 }
 
+// DataFormat specifies how the points in a response to a data request are
+// encoded.
+type DataFormat int
+
+const (
+	// TextDataFormat encodes the points as a JSON array of
+	// [millis, nanos, min, mean, max, count] arrays, or of
+	// [millis, nanos, value] arrays for raw values.
+	TextDataFormat DataFormat = iota
+
+	// BinaryDataFormat encodes each point as a packed little-endian record of
+	// BINARY_RECORD_SIZE bytes: the time in nanoseconds (int64), followed by
+	// the min, mean, and max (float64), followed by the count (uint64).
+	//
+	// Raw values are encoded as records of BINARY_RAW_RECORD_SIZE bytes: the
+	// time in nanoseconds (int64), followed by the value (float64).
+	BinaryDataFormat
+)
+
+const BINARY_RECORD_SIZE = 40
+const BINARY_RAW_RECORD_SIZE = 16
+
+/* Parses the name of a data format, as specified by the client. The empty
+   string refers to the default (text) format. */
+func parseDataFormat(name string) (DataFormat, bool) {
+	switch name {
+	case "", "text":
+		return TextDataFormat, true
+	case "binary":
+		return BinaryDataFormat, true
+	default:
+		return TextDataFormat, false
+	}
+}
+
+// DataQuery describes a request for the data in a time range of one or more
+// streams.
+type DataQuery struct {
+	UUIDs []uuid.UUID
+
+	// Versions contains the version to query for each stream, or 0 for the
+	// latest version.
+	Versions []uint64
+
+	StartTime int64
+	EndTime   int64
+
+	// PointWidth is the point width exponent for an aligned windows query, or
+	// the depth for a windows query. It is ignored for a raw values query.
+	PointWidth uint8
+
+	// WindowSize, if nonzero, is the window size in nanoseconds for a windows
+	// query.
+	WindowSize uint64
+
+	// Raw specifies a raw values query.
+	Raw bool
+
+	// ReportVersions specifies whether the version of each stream that was
+	// served is reported to the client. It is set for batch requests and for
+	// requests that pin a version, so that the responses to other requests
+	// are unchanged.
+	ReportVersions bool
+
+	// Derived, if not nil, contains the derived stream to query in place of
+	// each stream whose UUID is nil.
+	Derived []*DerivedQuery
+}
+
 type Writable interface {
 	GetWriter() io.Writer
 }
 
 type ConnWrapper struct {
-	Writing    *sync.Mutex
-	Conn       *ws.Conn
-	CurrWriter io.WriteCloser
+	Writing     *sync.Mutex
+	Conn        *ws.Conn
+	CurrWriter  io.WriteCloser
+	MessageType int
+}
+
+/* Writes MSG as a single message, immediately followed by a text message
+   containing ECHOTAG. Because the WebSocket is locked for the duration, the
+   client can always match a response to its request by the tag that follows
+   it. */
+func (cw *ConnWrapper) WriteResponse(msg []byte, echoTag string) error {
+	cw.Writing.Lock()
+	defer cw.Writing.Unlock()
+
+	err := cw.Conn.WriteMessage(cw.MessageType, msg)
+	if err != nil {
+		return err
+	}
+	return cw.Conn.WriteMessage(ws.TextMessage, []byte(echoTag))
+}
+
+/* Like WriteResponse, but sends an error response. Errors are always sent as
+   text messages, so that clients using the binary format can tell them apart
+   from data. */
+func (cw *ConnWrapper) WriteError(err error, echoTag string) error {
+	cw.Writing.Lock()
+	defer cw.Writing.Unlock()
+
+	werr := cw.Conn.WriteMessage(ws.TextMessage, marshalError(err))
+	if werr != nil {
+		return werr
+	}
+	return cw.Conn.WriteMessage(ws.TextMessage, []byte(echoTag))
 }
 
 func (cw *ConnWrapper) GetWriter() io.Writer {
 	cw.Writing.Lock()
-	w, err := cw.Conn.NextWriter(ws.TextMessage)
+	w, err := cw.Conn.NextWriter(cw.MessageType)
 	if err == nil {
 		cw.CurrWriter = w
 		return w
@@ -84,12 +187,15 @@ type DataRequester struct {
 	alive          bool
 
 	btrdb *btrdb.BTrDB
+	cache *reqcache.LRUCache
 }
 
-// NewDataRequester creates a new DataRequester object.
-// btrdbConn - established connection to a BTrDB cluster.
-// maxPending - a limit on the maximum number of pending requests. */
-func NewDataRequester(btrdbConn *btrdb.BTrDB, maxPending uint32) *DataRequester {
+/* Creates a new DataRequester object.
+   btrdbConn - established connection to a BTrDB cluster.
+   maxPending - a limit on the maximum number of pending requests.
+   cacheBytes - the memory budget for cached data responses, or 0 to disable
+   the cache. */
+func NewDataRequester(btrdbConn *btrdb.BTrDB, maxPending uint32, cacheBytes uint64) *DataRequester {
 	pendingLock := &sync.Mutex{}
 	var dr *DataRequester = &DataRequester{
 		totalWaiting:   0,
@@ -100,11 +206,37 @@ func NewDataRequester(btrdbConn *btrdb.BTrDB, maxPending uint32) *DataRequester
 		btrdb:          btrdbConn,
 	}
 
+	if cacheBytes != 0 {
+		dr.cache = reqcache.NewLRUCache(cacheBytes, dr.queryWindows, nil)
+	}
+
 	return dr
 }
 
-/* Makes a request for data and writes the result to the specified Writer. */
-func (dr *DataRequester) MakeDataRequest(ctx context.Context, uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8, writ Writable) {
+/* Makes the query Q for the Ith stream in Q, and writes the result to the
+   specified Writer. */
+func (dr *DataRequester) MakeQuery(ctx context.Context, q *DataQuery, i int, format DataFormat, writ Writable) (uint64, error) {
+	var version uint64
+	var err error
+	if q.Derived != nil && q.Derived[i] != nil {
+		version, err = dr.MakeDerivedRequest(ctx, q.Derived[i], q.StartTime, q.EndTime, q.WindowSize, q.PointWidth, q.Raw, format, writ)
+	} else if q.Raw {
+		version, err = dr.MakeRawDataRequest(ctx, q.UUIDs[i], q.Versions[i], q.StartTime, q.EndTime, format, writ)
+	} else {
+		version, err = dr.MakeDataRequest(ctx, q.UUIDs[i], q.Versions[i], q.StartTime, q.EndTime, q.WindowSize, q.PointWidth, format, writ)
+	}
+	return version, btrdbError(ctx, err)
+}
+
+/* Makes a request for data at the specified VERSION of the stream (0 meaning
+   the latest version) and writes the result to the specified Writer, encoded
+   according to FORMAT. If WINDOWSIZE is 0, this is an aligned windows query
+   with point width PW; otherwise, it is a windows query with the specified
+   window size and depth PW. The stream's transform, if it has one, is applied
+   to the points. Returns the version of the stream that was queried. If an
+   error is returned, the contents of the Writer are incomplete
+   and should be discarded. */
+func (dr *DataRequester) MakeDataRequest(ctx context.Context, uuidBytes uuid.UUID, version uint64, startTime int64, endTime int64, windowSize uint64, pw uint8, format DataFormat, writ Writable) (uint64, error) {
 	atomic.AddUint64(&dr.totalWaiting, 1)
 	defer atomic.AddUint64(&dr.totalWaiting, 0xFFFFFFFFFFFFFFFF)
 
@@ -122,28 +254,122 @@ func (dr *DataRequester) MakeDataRequest(ctx context.Context, uuidBytes uuid.UUI
 		dr.pendingLock.Unlock()
 	}()
 
-	var w io.Writer
-
 	var stream = dr.btrdb.StreamFromUUID(uuidBytes)
 
 	var exists bool
 	var err error
 	exists, err = stream.Exists(ctx)
-	if err != nil || !exists {
-		w = writ.GetWriter()
-		w.Write([]byte("[]"))
-		return
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errNoSuchStream(uuidBytes)
+	}
+
+	tf, err := streamTransform(ctx, uuidBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	var points []btrdb.StatPoint
+	if dr.cache != nil {
+		points, version, err = dr.cachedWindows(ctx, stream, version, startTime, endTime, windowSize, pw)
+	} else if windowSize == 0 {
+		points, version, err = collectStatPoints(stream.AlignedWindows(ctx, startTime, endTime, pw, version))
+	} else {
+		points, version, err = collectStatPoints(stream.Windows(ctx, startTime, endTime, windowSize, pw, version))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if tf != nil {
+		/* Cached points are shared, so they are copied, not modified. */
+		points = tf.ApplyStatPoints(points)
+	}
+
+	var w io.Writer = writ.GetWriter()
+	if format == BinaryDataFormat {
+		writeBinaryPoints(w, points)
+	} else {
+		writeTextPoints(w, points)
+	}
+
+	return version, nil
+}
+
+/* Like MakeDataRequest, but for the raw values in the time range. Fails
+   without writing anything if there are more than maxRawPoints values. */
+func (dr *DataRequester) MakeRawDataRequest(ctx context.Context, uuidBytes uuid.UUID, version uint64, startTime int64, endTime int64, format DataFormat, writ Writable) (uint64, error) {
+	atomic.AddUint64(&dr.totalWaiting, 1)
+	defer atomic.AddUint64(&dr.totalWaiting, 0xFFFFFFFFFFFFFFFF)
+
+	dr.pendingLock.Lock()
+	for dr.pending == dr.maxPending {
+		dr.pendingCondVar.Wait()
 	}
+	dr.pending += 1
+	dr.pendingLock.Unlock()
 
-	var results chan btrdb.StatPoint
-	var errors chan error
-	results, _, errors = stream.AlignedWindows(ctx, startTime, endTime, pw, 0)
+	defer func() {
+		dr.pendingLock.Lock()
+		dr.pending -= 1
+		dr.pendingCondVar.Signal()
+		dr.pendingLock.Unlock()
+	}()
 
-	w = writ.GetWriter()
+	var stream = dr.btrdb.StreamFromUUID(uuidBytes)
+
+	exists, err := stream.Exists(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errNoSuchStream(uuidBytes)
+	}
+
+	tf, err := streamTransform(ctx, uuidBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	/* Stop the query as soon as the cap is exceeded. */
+	queryctx, cancelfunc := context.WithCancel(ctx)
+	defer cancelfunc()
+
+	var points = make([]btrdb.RawPoint, 0)
+	results, versions, errors := stream.RawValues(queryctx, startTime, endTime, version)
+	for rawpt := range results {
+		if uint64(len(points)) == maxRawPoints {
+			cancelfunc()
+			for range results {
+			}
+			return 0, newPlotterError(http.StatusRequestEntityTooLarge, ERRCODE_TOO_LARGE, "Time range contains more than %d raw values", maxRawPoints)
+		}
+		points = append(points, rawpt)
+	}
+	if err = <-errors; err != nil {
+		return 0, err
+	}
+	version = <-versions
+	if tf != nil {
+		points = tf.ApplyRawPoints(points)
+	}
+
+	var w io.Writer = writ.GetWriter()
+	if format == BinaryDataFormat {
+		writeBinaryRawPoints(w, points)
+	} else {
+		writeTextRawPoints(w, points)
+	}
+
+	return version, nil
+}
+
+func writeTextPoints(w io.Writer, points []btrdb.StatPoint) {
 	w.Write([]byte("["))
 
 	var firstpt bool = true
-	for statpt := range results {
+	for _, statpt := range points {
 		millis, nanos := splitTime(statpt.Time)
 		if firstpt {
 			w.Write([]byte(fmt.Sprintf("[%v,%v,%v,%v,%v,%v]", millis, nanos, statpt.Min, statpt.Mean, statpt.Max, statpt.Count)))
@@ -153,18 +379,108 @@ func (dr *DataRequester) MakeDataRequest(ctx context.Context, uuidBytes uuid.UUI
 		}
 	}
 
-	var waserror bool = false
-	for err = range errors {
-		w.Write([]byte("\nError: "))
-		w.Write([]byte(err.Error()))
-		waserror = true
+	w.Write([]byte("]"))
+}
+
+func writeBinaryPoints(w io.Writer, points []btrdb.StatPoint) {
+	var record [BINARY_RECORD_SIZE]byte
+	for _, statpt := range points {
+		binary.LittleEndian.PutUint64(record[0:8], uint64(statpt.Time))
+		binary.LittleEndian.PutUint64(record[8:16], math.Float64bits(statpt.Min))
+		binary.LittleEndian.PutUint64(record[16:24], math.Float64bits(statpt.Mean))
+		binary.LittleEndian.PutUint64(record[24:32], math.Float64bits(statpt.Max))
+		binary.LittleEndian.PutUint64(record[32:40], statpt.Count)
+		w.Write(record[:])
 	}
+}
 
-	if !waserror {
-		w.Write([]byte("]"))
+func writeTextRawPoints(w io.Writer, points []btrdb.RawPoint) {
+	w.Write([]byte("["))
+
+	for i, rawpt := range points {
+		millis, nanos := splitTime(rawpt.Time)
+		if i == 0 {
+			w.Write([]byte(fmt.Sprintf("[%v,%v,%v]", millis, nanos, rawpt.Value)))
+		} else {
+			w.Write([]byte(fmt.Sprintf(",[%v,%v,%v]", millis, nanos, rawpt.Value)))
+		}
+	}
+
+	w.Write([]byte("]"))
+}
+
+func writeBinaryRawPoints(w io.Writer, points []btrdb.RawPoint) {
+	var record [BINARY_RAW_RECORD_SIZE]byte
+	for _, rawpt := range points {
+		binary.LittleEndian.PutUint64(record[0:8], uint64(rawpt.Time))
+		binary.LittleEndian.PutUint64(record[8:16], math.Float64bits(rawpt.Value))
+		w.Write(record[:])
 	}
 }
 
+/* Finds the time ranges of the stream that changed between FROMVERSION and
+   TOVERSION (0 meaning the latest version), at a granularity of 2^RESOLUTION
+   nanoseconds, and writes them to the specified Writer as JSON. If an error is
+   returned, nothing has been written. */
+func (dr *DataRequester) MakeChangesRequest(ctx context.Context, uuidBytes uuid.UUID, fromVersion uint64, toVersion uint64, resolution uint8, writ Writable) error {
+	atomic.AddUint64(&dr.totalWaiting, 1)
+	defer atomic.AddUint64(&dr.totalWaiting, 0xFFFFFFFFFFFFFFFF)
+
+	dr.pendingLock.Lock()
+	for dr.pending == dr.maxPending {
+		dr.pendingCondVar.Wait()
+	}
+	dr.pending += 1
+	dr.pendingLock.Unlock()
+
+	defer func() {
+		dr.pendingLock.Lock()
+		dr.pending -= 1
+		dr.pendingCondVar.Signal()
+		dr.pendingLock.Unlock()
+	}()
+
+	var stream = dr.btrdb.StreamFromUUID(uuidBytes)
+
+	exists, err := stream.Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errNoSuchStream(uuidBytes)
+	}
+
+	if toVersion == 0 {
+		toVersion, err = stream.Version(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ranges = make([]btrdb.ChangedRange, 0)
+	results, _, errors := stream.Changes(ctx, fromVersion, toVersion, resolution)
+	for cr := range results {
+		ranges = append(ranges, cr)
+	}
+	if err = <-errors; err != nil {
+		return err
+	}
+
+	var w io.Writer = writ.GetWriter()
+	w.Write([]byte(fmt.Sprintf("{\"FromVersion\":%v,\"ToVersion\":%v,\"Ranges\":[", fromVersion, toVersion)))
+	for i, cr := range ranges {
+		sMillis, sNanos := splitTime(cr.Start)
+		eMillis, eNanos := splitTime(cr.End)
+		if i != 0 {
+			w.Write([]byte(","))
+		}
+		w.Write([]byte(fmt.Sprintf("[[%v,%v],[%v,%v]]", sMillis, sNanos, eMillis, eNanos)))
+	}
+	w.Write([]byte("]}"))
+
+	return nil
+}
+
 func (dr *DataRequester) MakeBracketRequest(ctx context.Context, uuids []uuid.UUID, writ Writable) {
 	atomic.AddUint64(&dr.totalWaiting, 1)
 	defer atomic.AddUint64(&dr.totalWaiting, 0xFFFFFFFFFFFFFFFF)
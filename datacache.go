@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the cache of responses to data requests. Each entry is
+   keyed by the version of the stream that it was computed from, so once a
+   stream is modified, subsequent requests look up a different key and the
+   stale entries are never returned again; they fall out of the cache as it
+   evicts the least recently used entries. */
+
+package main
+
+import (
+	"context"
+	"unsafe"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/pborman/uuid"
+)
+
+/* Approximate memory used by a cache entry, excluding the points themselves. */
+const DATA_CACHE_ENTRY_OVERHEAD uint64 = 128
+
+/* A query for aligned windows if width is 0, or for windows otherwise. */
+type WindowsQuery struct {
+	uu      uuid.Array
+	version uint64
+	start   int64
+	end     int64
+	width   uint64
+	pw      uint8
+}
+
+/* Reads all of the points produced by a query and the version of the stream
+   that was queried, or the error that ended the query. */
+func collectStatPoints(results chan btrdb.StatPoint, versions chan uint64, errors chan error) ([]btrdb.StatPoint, uint64, error) {
+	var points = make([]btrdb.StatPoint, 0)
+	for statpt := range results {
+		points = append(points, statpt)
+	}
+	if err := <-errors; err != nil {
+		return nil, 0, err
+	}
+	return points, <-versions, nil
+}
+
+/* Looks up the result of an AlignedWindows query (or a Windows query, if
+   WINDOWSIZE is nonzero) for the specified version of the stream (0 meaning
+   the latest version), querying BTrDB if it is not in the cache. Returns the
+   points and the version that they came from. */
+func (dr *DataRequester) cachedWindows(ctx context.Context, stream *btrdb.Stream, version uint64, startTime int64, endTime int64, windowSize uint64, pw uint8) ([]btrdb.StatPoint, uint64, error) {
+	var err error
+	if version == 0 {
+		version, err = stream.Version(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	query := WindowsQuery{
+		uu:      stream.UUID().Array(),
+		version: version,
+		start:   startTime,
+		end:     endTime,
+		width:   windowSize,
+		pw:      pw,
+	}
+	points, err := dr.cache.Get(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return points.([]btrdb.StatPoint), version, nil
+}
+
+func (dr *DataRequester) queryWindows(ctx context.Context, key interface{}) (interface{}, uint64, error) {
+	query := key.(WindowsQuery)
+	s := dr.btrdb.StreamFromUUID(query.uu.UUID())
+	var points []btrdb.StatPoint
+	var err error
+	if query.width == 0 {
+		points, _, err = collectStatPoints(s.AlignedWindows(ctx, query.start, query.end, query.pw, query.version))
+	} else {
+		points, _, err = collectStatPoints(s.Windows(ctx, query.start, query.end, query.width, query.pw, query.version))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var size = DATA_CACHE_ENTRY_OVERHEAD + uint64(len(points))*uint64(unsafe.Sizeof(btrdb.StatPoint{}))
+	return points, size, nil
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package derived implements virtual streams, whose values are computed from
+// the values of stored streams using arithmetic expressions.
+//
+// An expression is made of numbers, variables (each of which stands for a
+// stream), the operators +, -, *, / and ^ (exponentiation), parentheses, the
+// constant pi, and the functions sqrt, abs, exp, log, log10, sin, cos, min and
+// max. For example, "a - b", "a * 1.732" and "sqrt(a^2 + b^2)".
+package derived
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Expr is a parsed expression.
+type Expr struct {
+	root node
+
+	// Variables contains the name of each variable in the expression, in
+	// order of first appearance. Values are given to Eval and Bounds in the
+	// same order.
+	Variables []string
+}
+
+// Eval evaluates the expression, given the value of each variable.
+func (e *Expr) Eval(values []float64) float64 {
+	return e.root.eval(values)
+}
+
+// Bounds returns bounds on the value of the expression, given that the value
+// of each variable i is between lo[i] and hi[i], inclusive.
+func (e *Expr) Bounds(lo []float64, hi []float64) (float64, float64) {
+	return e.root.bounds(lo, hi)
+}
+
+type node interface {
+	eval(values []float64) float64
+	bounds(lo []float64, hi []float64) (float64, float64)
+}
+
+type constNode float64
+
+func (n constNode) eval(values []float64) float64 {
+	return float64(n)
+}
+
+func (n constNode) bounds(lo []float64, hi []float64) (float64, float64) {
+	return float64(n), float64(n)
+}
+
+type varNode int
+
+func (n varNode) eval(values []float64) float64 {
+	return values[n]
+}
+
+func (n varNode) bounds(lo []float64, hi []float64) (float64, float64) {
+	return lo[n], hi[n]
+}
+
+type negNode struct {
+	x node
+}
+
+func (n negNode) eval(values []float64) float64 {
+	return -n.x.eval(values)
+}
+
+func (n negNode) bounds(lo []float64, hi []float64) (float64, float64) {
+	a, b := n.x.bounds(lo, hi)
+	return -b, -a
+}
+
+type binaryNode struct {
+	op byte
+	x  node
+	y  node
+}
+
+func (n binaryNode) eval(values []float64) float64 {
+	x := n.x.eval(values)
+	y := n.y.eval(values)
+	switch n.op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	case '/':
+		return x / y
+	default:
+		return math.Pow(x, y)
+	}
+}
+
+func (n binaryNode) bounds(lo []float64, hi []float64) (float64, float64) {
+	a, b := n.x.bounds(lo, hi)
+	c, d := n.y.bounds(lo, hi)
+	switch n.op {
+	case '+':
+		return a + c, b + d
+	case '-':
+		return a - d, b - c
+	case '*':
+		return extremes(a*c, a*d, b*c, b*d)
+	case '/':
+		if c <= 0 && d >= 0 {
+			return math.Inf(-1), math.Inf(1)
+		}
+		return extremes(a/c, a/d, b/c, b/d)
+	default:
+		if c == d && c == math.Trunc(c) {
+			return powBounds(a, b, c)
+		}
+		/* x^y is only defined for x >= 0 here, so only that part of
+		   [a, b] is considered. */
+		if b < 0 {
+			return math.NaN(), math.NaN()
+		}
+		a = math.Max(a, 0)
+		/* y*ln(x) is bilinear, so x^y is extreme at the corners. */
+		return extremes(math.Pow(a, c), math.Pow(a, d), math.Pow(b, c), math.Pow(b, d))
+	}
+}
+
+/* Bounds on x^n for x in [a, b], where n is an integer. */
+func powBounds(a float64, b float64, n float64) (float64, float64) {
+	pa := math.Pow(a, n)
+	pb := math.Pow(b, n)
+	if n < 0 && a <= 0 && b >= 0 {
+		if math.Mod(n, 2) == 0 {
+			return math.Min(pa, pb), math.Inf(1)
+		}
+		return math.Inf(-1), math.Inf(1)
+	}
+	if n > 0 && math.Mod(n, 2) == 0 && a < 0 && b > 0 {
+		return 0, math.Max(pa, pb)
+	}
+	return extremes(pa, pb)
+}
+
+func extremes(values ...float64) (float64, float64) {
+	min, max := values[0], values[0]
+	for _, v := range values[1:] {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	return min, max
+}
+
+type function struct {
+	minArgs int
+	maxArgs int
+	eval    func(args []float64) float64
+	bounds  func(lo []float64, hi []float64) (float64, float64)
+}
+
+/* Makes a function of one argument that is nondecreasing on its domain. */
+func monotonic(f func(float64) float64) *function {
+	return &function{
+		minArgs: 1,
+		maxArgs: 1,
+		eval:    func(args []float64) float64 { return f(args[0]) },
+		bounds:  func(lo []float64, hi []float64) (float64, float64) { return f(lo[0]), f(hi[0]) },
+	}
+}
+
+/* Like monotonic, for a function whose domain is x >= 0. Bounds are taken
+   over the part of the argument's range that is in the domain. */
+func monotonicNonNegative(f func(float64) float64) *function {
+	fn := monotonic(f)
+	fn.bounds = func(lo []float64, hi []float64) (float64, float64) {
+		return f(math.Max(lo[0], 0)), f(hi[0])
+	}
+	return fn
+}
+
+/* Bounds on cos(x) for x in [a, b]. */
+func cosBounds(a float64, b float64) (float64, float64) {
+	if b-a >= 2*math.Pi {
+		return -1, 1
+	}
+	min, max := extremes(math.Cos(a), math.Cos(b))
+	if 2*math.Pi*math.Ceil(a/(2*math.Pi)) <= b {
+		max = 1
+	}
+	if 2*math.Pi*math.Ceil((a-math.Pi)/(2*math.Pi))+math.Pi <= b {
+		min = -1
+	}
+	return min, max
+}
+
+var functions = map[string]*function{
+	"sqrt":  monotonicNonNegative(math.Sqrt),
+	"exp":   monotonic(math.Exp),
+	"log":   monotonicNonNegative(math.Log),
+	"log10": monotonicNonNegative(math.Log10),
+	"abs": {
+		minArgs: 1,
+		maxArgs: 1,
+		eval:    func(args []float64) float64 { return math.Abs(args[0]) },
+		bounds: func(lo []float64, hi []float64) (float64, float64) {
+			switch {
+			case lo[0] >= 0:
+				return lo[0], hi[0]
+			case hi[0] <= 0:
+				return -hi[0], -lo[0]
+			default:
+				return 0, math.Max(-lo[0], hi[0])
+			}
+		},
+	},
+	"cos": {
+		minArgs: 1,
+		maxArgs: 1,
+		eval:    func(args []float64) float64 { return math.Cos(args[0]) },
+		bounds: func(lo []float64, hi []float64) (float64, float64) {
+			return cosBounds(lo[0], hi[0])
+		},
+	},
+	"sin": {
+		minArgs: 1,
+		maxArgs: 1,
+		eval:    func(args []float64) float64 { return math.Sin(args[0]) },
+		bounds: func(lo []float64, hi []float64) (float64, float64) {
+			return cosBounds(lo[0]-math.Pi/2, hi[0]-math.Pi/2)
+		},
+	},
+	"min": {
+		minArgs: 2,
+		maxArgs: -1,
+		eval: func(args []float64) float64 {
+			min, _ := extremes(args...)
+			return min
+		},
+		bounds: func(lo []float64, hi []float64) (float64, float64) {
+			a, _ := extremes(lo...)
+			b, _ := extremes(hi...)
+			return a, b
+		},
+	},
+	"max": {
+		minArgs: 2,
+		maxArgs: -1,
+		eval: func(args []float64) float64 {
+			_, max := extremes(args...)
+			return max
+		},
+		bounds: func(lo []float64, hi []float64) (float64, float64) {
+			_, a := extremes(lo...)
+			_, b := extremes(hi...)
+			return a, b
+		},
+	},
+}
+
+var constants = map[string]float64{
+	"pi": math.Pi,
+}
+
+type callNode struct {
+	fn   *function
+	args []node
+}
+
+func (n callNode) eval(values []float64) float64 {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.eval(values)
+	}
+	return n.fn.eval(args)
+}
+
+func (n callNode) bounds(lo []float64, hi []float64) (float64, float64) {
+	argslo := make([]float64, len(n.args))
+	argshi := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		argslo[i], argshi[i] = arg.bounds(lo, hi)
+	}
+	return n.fn.bounds(argslo, argshi)
+}
+
+/* The parser is a recursive descent parser for the following grammar:
+
+   expr    := term (('+' | '-') term)*
+   term    := unary (('*' | '/') unary)*
+   unary   := '-' unary | power
+   power   := primary ('^' unary)?
+   primary := number | name | name '(' expr (',' expr)* ')' | '(' expr ')'
+
+   so exponentiation is right-associative and binds more tightly than
+   negation, as in "-a^2". */
+type parser struct {
+	input     string
+	pos       int
+	variables map[string]int
+	names     []string
+}
+
+// Parse parses an expression.
+func Parse(input string) (*Expr, error) {
+	p := &parser{
+		input:     input,
+		variables: make(map[string]int),
+	}
+	root, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos])
+	}
+	return &Expr{root: root, Variables: p.names}, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid expression at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) skipSpace() {
+	for p.pos != len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+/* Consumes the next character if it is C. */
+func (p *parser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos != len(p.input) && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expr() (node, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		if p.accept('+') {
+			op = '+'
+		} else if p.accept('-') {
+			op = '-'
+		} else {
+			return x, nil
+		}
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryNode{op, x, y}
+	}
+}
+
+func (p *parser) term() (node, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		if p.accept('*') {
+			op = '*'
+		} else if p.accept('/') {
+			op = '/'
+		} else {
+			return x, nil
+		}
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryNode{op, x, y}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept('-') {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negNode{x}, nil
+	}
+	return p.power()
+}
+
+func (p *parser) power() (node, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept('^') {
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryNode{'^', x, y}, nil
+	}
+	return x, nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || isDigit(c)
+}
+
+func (p *parser) primary() (node, error) {
+	p.skipSpace()
+	if p.pos == len(p.input) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+
+	var start = p.pos
+	var c = p.input[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, p.errorf("expected ')'")
+		}
+		return x, nil
+
+	case isDigit(c) || c == '.':
+		for p.pos != len(p.input) && (isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		if p.pos != len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+			p.pos++
+			if p.pos != len(p.input) && (p.input[p.pos] == '+' || p.input[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos != len(p.input) && isDigit(p.input[p.pos]) {
+				p.pos++
+			}
+		}
+		var text = p.input[start:p.pos]
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number %q", text)
+		}
+		return constNode(value), nil
+
+	case isNameChar(c):
+		for p.pos != len(p.input) && isNameChar(p.input[p.pos]) {
+			p.pos++
+		}
+		var name = p.input[start:p.pos]
+		if p.accept('(') {
+			return p.call(name)
+		}
+		if value, ok := constants[name]; ok {
+			return constNode(value), nil
+		}
+		if _, ok := functions[name]; ok {
+			return nil, p.errorf("function %s must be called", name)
+		}
+		index, ok := p.variables[name]
+		if !ok {
+			index = len(p.names)
+			p.variables[name] = index
+			p.names = append(p.names, name)
+		}
+		return varNode(index), nil
+
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func (p *parser) call(name string) (node, error) {
+	fn, ok := functions[name]
+	if !ok {
+		return nil, p.errorf("unknown function %s", name)
+	}
+	var args []node
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(')') {
+			break
+		}
+		if !p.accept(',') {
+			return nil, p.errorf("expected ',' or ')'")
+		}
+	}
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, p.errorf("wrong number of arguments to %s", name)
+	}
+	return callNode{fn, args}, nil
+}
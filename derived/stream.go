@@ -0,0 +1,277 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package derived
+
+import (
+	"context"
+	"math"
+
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/BTrDB/mr-plotter/transform"
+)
+
+const outputBufferSize = 100
+
+// Stream is a virtual stream, whose value at each time is the value of an
+// expression over the values of stored streams at that time. It has a point
+// only at the times where every input stream has a point, and where the value
+// of the expression is finite.
+//
+// The query methods mirror those of btrdb.Stream. For statistical points, the
+// mean of the derived stream is the expression evaluated on the means of the
+// inputs; the minimum and maximum bound the expression evaluated on any
+// values between the minimums and maximums of the inputs, and the count is the
+// smallest count of any input. Where such a bound is not finite (for example,
+// if the inputs range across a pole of the expression), it is replaced with
+// the mean. The version reported by each query is always 0,
+// since a derived stream has no version of its own.
+type Stream struct {
+	Expr *Expr
+
+	// Inputs contains the stream for each variable of Expr, in the same
+	// order as Expr.Variables.
+	Inputs []*btrdb.Stream
+
+	// Versions contains the version to query for each input, or 0 for the
+	// latest version.
+	Versions []uint64
+
+	// Transforms, if not nil, contains the transform to apply to each input
+	// before the expression is evaluated, or nil for no transform.
+	Transforms []*transform.Transform
+}
+
+func (s *Stream) transform(i int) *transform.Transform {
+	if s.Transforms == nil {
+		return nil
+	}
+	return s.Transforms[i]
+}
+
+/* A point of an input stream; a raw point has the same minimum, mean, and
+   maximum. */
+type sample struct {
+	time  int64
+	min   float64
+	mean  float64
+	max   float64
+	count uint64
+}
+
+func isFinite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+// AlignedWindows is like btrdb.Stream.AlignedWindows.
+func (s *Stream) AlignedWindows(ctx context.Context, start int64, end int64, pw uint8) (chan btrdb.StatPoint, chan uint64, chan error) {
+	var qctx, cancel = context.WithCancel(ctx)
+	var inputs = make([]func() (sample, bool), len(s.Inputs))
+	var errcs = make([]chan error, len(s.Inputs))
+	for i, input := range s.Inputs {
+		var statc chan btrdb.StatPoint
+		statc, _, errcs[i] = input.AlignedWindows(qctx, start, end, pw, s.Versions[i])
+		inputs[i] = statReader(statc, s.transform(i))
+	}
+	return s.joinStatPoints(ctx, cancel, inputs, errcs)
+}
+
+// Windows is like btrdb.Stream.Windows.
+func (s *Stream) Windows(ctx context.Context, start int64, end int64, width uint64, depth uint8) (chan btrdb.StatPoint, chan uint64, chan error) {
+	var qctx, cancel = context.WithCancel(ctx)
+	var inputs = make([]func() (sample, bool), len(s.Inputs))
+	var errcs = make([]chan error, len(s.Inputs))
+	for i, input := range s.Inputs {
+		var statc chan btrdb.StatPoint
+		statc, _, errcs[i] = input.Windows(qctx, start, end, width, depth, s.Versions[i])
+		inputs[i] = statReader(statc, s.transform(i))
+	}
+	return s.joinStatPoints(ctx, cancel, inputs, errcs)
+}
+
+// RawValues is like btrdb.Stream.RawValues.
+func (s *Stream) RawValues(ctx context.Context, start int64, end int64) (chan btrdb.RawPoint, chan uint64, chan error) {
+	var qctx, cancel = context.WithCancel(ctx)
+	var inputs = make([]func() (sample, bool), len(s.Inputs))
+	var errcs = make([]chan error, len(s.Inputs))
+	for i, input := range s.Inputs {
+		var rawc chan btrdb.RawPoint
+		rawc, _, errcs[i] = input.RawValues(qctx, start, end, s.Versions[i])
+		inputs[i] = rawReader(rawc, s.transform(i))
+	}
+
+	var out = make(chan btrdb.RawPoint, outputBufferSize)
+	var verc = make(chan uint64, 1)
+	var errc = make(chan error, 1)
+	verc <- 0
+	go func() {
+		var values = make([]float64, len(inputs))
+		var err = s.join(ctx, cancel, inputs, errcs, func(samples []sample) bool {
+			for i := range samples {
+				values[i] = samples[i].mean
+			}
+			var value = s.Expr.Eval(values)
+			if !isFinite(value) {
+				return true
+			}
+			select {
+			case out <- btrdb.RawPoint{Time: samples[0].time, Value: value}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		close(out)
+		errc <- err
+	}()
+	return out, verc, errc
+}
+
+func (s *Stream) joinStatPoints(ctx context.Context, cancel context.CancelFunc, inputs []func() (sample, bool), errcs []chan error) (chan btrdb.StatPoint, chan uint64, chan error) {
+	var out = make(chan btrdb.StatPoint, outputBufferSize)
+	var verc = make(chan uint64, 1)
+	var errc = make(chan error, 1)
+	verc <- 0
+	go func() {
+		var lo = make([]float64, len(inputs))
+		var means = make([]float64, len(inputs))
+		var hi = make([]float64, len(inputs))
+		var err = s.join(ctx, cancel, inputs, errcs, func(samples []sample) bool {
+			var count = samples[0].count
+			for i := range samples {
+				lo[i], means[i], hi[i] = samples[i].min, samples[i].mean, samples[i].max
+				if samples[i].count < count {
+					count = samples[i].count
+				}
+			}
+			var pt = btrdb.StatPoint{Time: samples[0].time, Mean: s.Expr.Eval(means), Count: count}
+			if !isFinite(pt.Mean) {
+				return true
+			}
+			pt.Min, pt.Max = s.Expr.Bounds(lo, hi)
+			if !isFinite(pt.Min) {
+				pt.Min = pt.Mean
+			}
+			if !isFinite(pt.Max) {
+				pt.Max = pt.Mean
+			}
+			pt.Min, pt.Max = math.Min(pt.Min, pt.Mean), math.Max(pt.Max, pt.Mean)
+			select {
+			case out <- pt:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		close(out)
+		errc <- err
+	}()
+	return out, verc, errc
+}
+
+func statReader(c chan btrdb.StatPoint, tf *transform.Transform) func() (sample, bool) {
+	return func() (sample, bool) {
+		pt, ok := <-c
+		if tf != nil {
+			pt = tf.ApplyStatPoint(pt)
+		}
+		return sample{pt.Time, pt.Min, pt.Mean, pt.Max, pt.Count}, ok
+	}
+}
+
+func rawReader(c chan btrdb.RawPoint, tf *transform.Transform) func() (sample, bool) {
+	return func() (sample, bool) {
+		pt, ok := <-c
+		if tf != nil {
+			pt.Value = tf.Apply(pt.Value)
+		}
+		return sample{pt.Time, pt.Value, pt.Value, pt.Value, 1}, ok
+	}
+}
+
+/* Reads the inputs in order of time, calling EMIT with the points of all
+   inputs at each time where every input has a point, until an input is
+   exhausted or EMIT returns false. Then calls CANCEL, which must cancel the
+   queries of the inputs, and returns the first error reported by an input
+   that was read to the end. */
+func (s *Stream) join(ctx context.Context, cancel context.CancelFunc, inputs []func() (sample, bool), errcs []chan error, emit func([]sample) bool) error {
+	defer cancel()
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	var heads = make([]sample, len(inputs))
+	var open = make([]bool, len(inputs))
+	var ok = true
+	for i, next := range inputs {
+		heads[i], open[i] = next()
+		ok = ok && open[i]
+	}
+
+	for ok {
+		/* No input has a point before the latest head, so that is the
+		   earliest time at which all of them might have a point. */
+		var t = heads[0].time
+		for i := range heads {
+			if heads[i].time > t {
+				t = heads[i].time
+			}
+		}
+		var aligned = true
+		for i, next := range inputs {
+			for ok && heads[i].time < t {
+				heads[i], open[i] = next()
+				ok = open[i]
+			}
+			aligned = aligned && heads[i].time == t
+		}
+		if !ok || !aligned {
+			continue
+		}
+
+		if !emit(heads) {
+			break
+		}
+		for i, next := range inputs {
+			heads[i], open[i] = next()
+			ok = ok && open[i]
+		}
+	}
+
+	/* The queries that are still running fail once they are canceled, so
+	   their errors are ignored. The rest of their points are read so that
+	   they can finish. */
+	cancel()
+	var err error
+	for i, next := range inputs {
+		var canceled = open[i]
+		for open[i] {
+			_, open[i] = next()
+		}
+		if ierr := <-errcs[i]; err == nil && !canceled {
+			err = ierr
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for serving derived streams, which are
+   computed from stored streams by an expression (see the derived package).
+   A derived stream is described by a JSON document of the form
+   {"Expression": "sqrt(a^2 + b^2)", "Variables": {"a": "<uuid>[@<version>]",
+   "b": ...}}. In a request to /data or /dataws, it is given in place of a
+   UUID as DERIVED_PREFIX followed by the document, base64-encoded with the
+   URL-safe alphabet and no padding; in a request to /csv, it is given in the
+   Derived field. The user must have permission to see every input stream. */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/BTrDB/mr-plotter/derived"
+	"github.com/BTrDB/mr-plotter/transform"
+
+	"github.com/pborman/uuid"
+)
+
+const DERIVED_PREFIX string = "="
+const MAX_DERIVED_INPUTS int = 16
+
+// DerivedSpec describes a derived stream. Each variable in the expression
+// must be bound to a stream.
+type DerivedSpec struct {
+	Expression string
+	Variables  map[string]string
+
+	/* Only used for CSV files. */
+	Label string `json:",omitempty"`
+}
+
+// DerivedQuery is a derived stream to be queried.
+type DerivedQuery struct {
+	/* The string that identified the stream in the request. */
+	ID     string
+	Stream *derived.Stream
+	Inputs []uuid.UUID
+}
+
+func parseDerivedSpec(spec *DerivedSpec) (*DerivedQuery, error) {
+	expr, err := derived.Parse(spec.Expression)
+	if err != nil {
+		return nil, errBadRequest("%v", err)
+	}
+	if len(expr.Variables) == 0 {
+		return nil, errBadRequest("Expression %q does not refer to any streams", spec.Expression)
+	}
+	if len(expr.Variables) > MAX_DERIVED_INPUTS {
+		return nil, errBadRequest("Expression %q refers to more than %d streams", spec.Expression, MAX_DERIVED_INPUTS)
+	}
+	if len(spec.Variables) != len(expr.Variables) {
+		return nil, errBadRequest("Expression %q has %d variables, but %d are bound", spec.Expression, len(expr.Variables), len(spec.Variables))
+	}
+
+	var d = &DerivedQuery{
+		Stream: &derived.Stream{
+			Expr:     expr,
+			Inputs:   make([]*btrdb.Stream, len(expr.Variables)),
+			Versions: make([]uint64, len(expr.Variables)),
+		},
+		Inputs: make([]uuid.UUID, len(expr.Variables)),
+	}
+	for i, name := range expr.Variables {
+		uuidstr, ok := spec.Variables[name]
+		if !ok {
+			return nil, errBadRequest("Variable %s is not bound to a stream", name)
+		}
+		if sep := strings.Index(uuidstr, VERSION_SEPARATOR); sep != -1 {
+			d.Stream.Versions[i], err = strconv.ParseUint(uuidstr[sep+1:], 10, 64)
+			if err != nil {
+				return nil, errBadRequest("Could not interpret %v as a version number: %v", uuidstr[sep+1:], err)
+			}
+			uuidstr = uuidstr[:sep]
+		}
+		d.Inputs[i] = uuid.Parse(uuidstr)
+		if d.Inputs[i] == nil {
+			return nil, errBadRequest("Invalid UUID: got %v", uuidstr)
+		}
+		d.Stream.Inputs[i] = btrdbConn.StreamFromUUID(d.Inputs[i])
+	}
+	return d, nil
+}
+
+/* Parses a derived stream given in place of a UUID in a data request. */
+func parseDerivedID(id string) (*DerivedQuery, error) {
+	encoded, err := base64.RawURLEncoding.DecodeString(id[len(DERIVED_PREFIX):])
+	if err != nil {
+		return nil, errBadRequest("Could not decode derived stream: %v", err)
+	}
+	var spec DerivedSpec
+	if err = json.Unmarshal(encoded, &spec); err != nil {
+		return nil, errBadRequest("Malformed derived stream: %v", err)
+	}
+	d, err := parseDerivedSpec(&spec)
+	if err != nil {
+		return nil, err
+	}
+	d.ID = id
+	return d, nil
+}
+
+/* Checks that the user has permission to see every input of the derived
+   stream. */
+func (d *DerivedQuery) checkPermission(ctx context.Context, ls *LoginSession) error {
+	for _, uu := range d.Inputs {
+		if err := checkPermission(ctx, ls, uu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Checks that every input of the derived stream exists, and retrieves the
+   transforms of the inputs, so that they are used by the expression. */
+func (d *DerivedQuery) prepare(ctx context.Context) error {
+	d.Stream.Transforms = make([]*transform.Transform, len(d.Inputs))
+	for i, s := range d.Stream.Inputs {
+		exists, err := s.Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errNoSuchStream(d.Inputs[i])
+		}
+		d.Stream.Transforms[i], err = streamTransform(ctx, d.Inputs[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Returns the string that identifies the Ith stream of Q in responses. */
+func (q *DataQuery) streamID(i int) string {
+	if q.Derived != nil && q.Derived[i] != nil {
+		return q.Derived[i].ID
+	}
+	return q.UUIDs[i].String()
+}
+
+/* Checks that the user has permission to see the Ith stream of Q, or all of
+   its inputs if it is a derived stream. */
+func (q *DataQuery) checkPermission(ctx context.Context, ls *LoginSession, i int) error {
+	if q.Derived != nil && q.Derived[i] != nil {
+		return q.Derived[i].checkPermission(ctx, ls)
+	}
+	return checkPermission(ctx, ls, q.UUIDs[i])
+}
+
+/* Like MakeDataRequest and MakeRawDataRequest, but for a derived stream. The
+   version returned is always 0. */
+func (dr *DataRequester) MakeDerivedRequest(ctx context.Context, d *DerivedQuery, startTime int64, endTime int64, windowSize uint64, pw uint8, raw bool, format DataFormat, writ Writable) (uint64, error) {
+	atomic.AddUint64(&dr.totalWaiting, 1)
+	defer atomic.AddUint64(&dr.totalWaiting, 0xFFFFFFFFFFFFFFFF)
+
+	dr.pendingLock.Lock()
+	for dr.pending == dr.maxPending {
+		dr.pendingCondVar.Wait()
+	}
+	dr.pending += 1
+	dr.pendingLock.Unlock()
+
+	defer func() {
+		dr.pendingLock.Lock()
+		dr.pending -= 1
+		dr.pendingCondVar.Signal()
+		dr.pendingLock.Unlock()
+	}()
+
+	if err := d.prepare(ctx); err != nil {
+		return 0, err
+	}
+
+	queryctx, cancelfunc := context.WithCancel(ctx)
+	defer cancelfunc()
+
+	var w io.Writer
+	if raw {
+		var points = make([]btrdb.RawPoint, 0)
+		results, _, errors := d.Stream.RawValues(queryctx, startTime, endTime)
+		for rawpt := range results {
+			if uint64(len(points)) == maxRawPoints {
+				cancelfunc()
+				for range results {
+				}
+				return 0, newPlotterError(http.StatusRequestEntityTooLarge, ERRCODE_TOO_LARGE, "Time range contains more than %d raw values", maxRawPoints)
+			}
+			points = append(points, rawpt)
+		}
+		if err := <-errors; err != nil {
+			return 0, err
+		}
+
+		w = writ.GetWriter()
+		if format == BinaryDataFormat {
+			writeBinaryRawPoints(w, points)
+		} else {
+			writeTextRawPoints(w, points)
+		}
+		return 0, nil
+	}
+
+	var points []btrdb.StatPoint
+	var err error
+	if windowSize == 0 {
+		points, _, err = collectStatPoints(d.Stream.AlignedWindows(queryctx, startTime, endTime, pw))
+	} else {
+		points, _, err = collectStatPoints(d.Stream.Windows(queryctx, startTime, endTime, windowSize, pw))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	w = writ.GetWriter()
+	if format == BinaryDataFormat {
+		writeBinaryPoints(w, points)
+	} else {
+		writeTextPoints(w, points)
+	}
+	return 0, nil
+}
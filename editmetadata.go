@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for editing the annotations of a stream. A
+   client POSTs a JSON document of the form {"UUID": "<uuid>",
+   "Version": <annotation version>, "Annotations": {"name": "...",
+   "unit": null}, "_token": "<token>"} to /editmetadata. Each annotation is set
+   to the given value, or removed if the value is null; other annotations are
+   left alone.
+
+   The user must be logged in as a member of a group with the "plotter-write"
+   capability whose prefixes include the stream's collection. Version, which
+   is required, is the annotation version the client saw (the
+   "annotationVersion" field of the stream's metadata). If the annotations
+   were changed since that version, nothing is changed and a conflict error is
+   returned, so that the client can fetch the metadata again and retry. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/pborman/uuid"
+)
+
+/* The code of the error BTrDB returns when the expected annotation version
+   passed to CompareAndSetAnnotation is not the current one. */
+const BTRDB_ANNOTATION_VERSION_MISMATCH = 414
+
+// EditMetadataRequest is a request to change the annotations of a stream.
+type EditMetadataRequest struct {
+	UUID        string
+	Version     *uint64
+	Annotations map[string]*string
+	Token       string `json:"_token,omitempty"`
+}
+
+func editmetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if onlyallowpost(w, r) {
+		return
+	}
+
+	payload, ok := readfullbody(w, r)
+	if !ok {
+		return
+	}
+
+	var req EditMetadataRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		writeError(w, errBadRequest("Received invalid JSON: %v", err))
+		return
+	}
+	uu := uuid.Parse(req.UUID)
+	if uu == nil {
+		writeError(w, errBadRequest("Invalid UUID: got %v", req.UUID))
+		return
+	}
+	if req.Version == nil {
+		writeError(w, errBadRequest("Missing annotation version"))
+		return
+	}
+	if len(req.Annotations) == 0 {
+		writeError(w, errBadRequest("No annotations to change"))
+		return
+	}
+	for key := range req.Annotations {
+		if key == "" {
+			writeError(w, errBadRequest("Annotation keys must not be empty"))
+			return
+		}
+	}
+
+	loginsession, err := sessionFromToken(req.Token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if loginsession == nil {
+		writeError(w, errInvalidToken())
+		return
+	}
+
+	var ctx = r.Context()
+	var cancelfunc context.CancelFunc
+	if mdTimeout >= 0 {
+		ctx, cancelfunc = context.WithTimeout(ctx, mdTimeout)
+	} else {
+		ctx, cancelfunc = context.WithCancel(ctx)
+	}
+	defer cancelfunc()
+
+	s := btrdbConn.StreamFromUUID(uu)
+	ex, err := s.Exists(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !ex {
+		writeError(w, errNoSuchStream(uu))
+		return
+	}
+	collection, err := s.Collection(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkPermission(ctx, loginsession, uu); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !hasWritePermission(loginsession, collection) {
+		writeError(w, errPermissionDenied(uu))
+		return
+	}
+
+	err = s.CompareAndSetAnnotation(ctx, *req.Version, req.Annotations)
+	if err != nil {
+		if btrdb.ToCodedError(err).Code == BTRDB_ANNOTATION_VERSION_MISMATCH {
+			writeError(w, newPlotterError(http.StatusConflict, ERRCODE_CONFLICT, "The annotations of stream %s were changed since version %d", uu.String(), *req.Version))
+		} else {
+			writeError(w, err)
+		}
+		return
+	}
+
+	ann, newVersion, err := s.Annotations(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	leafname, err := streamtoleafname(ctx, s)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	updateIndexedAnnotations(uu, leafname, ann, newVersion)
+	encoded, err := json.Marshal(map[string]interface{}{
+		"uuid":              uu.String(),
+		"annotations":       ann,
+		"annotationVersion": newVersion,
+	})
+	if err != nil {
+		writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not encode annotations: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(encoded)
+}
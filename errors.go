@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for reporting errors to clients. Every error
+   is sent as a JSON document of the form
+   {"error": {"code": <machine-readable code>, "message": <description>}}
+   with an appropriate HTTP status. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/pborman/uuid"
+)
+
+/* Error codes, reported in the "code" field of an error response. */
+const (
+	ERRCODE_BAD_REQUEST         string = "bad_request"
+	ERRCODE_METHOD_NOT_ALLOWED  string = "method_not_allowed"
+	ERRCODE_INVALID_TOKEN       string = "invalid_token"
+	ERRCODE_INVALID_CREDENTIALS string = "invalid_credentials"
+	ERRCODE_PERMISSION_DENIED   string = "permission_denied"
+	ERRCODE_NO_SUCH_STREAM      string = "no_such_stream"
+	ERRCODE_NOT_FOUND           string = "not_found"
+	ERRCODE_CONFLICT            string = "conflict"
+	ERRCODE_TOO_LARGE           string = "too_large"
+	ERRCODE_NOT_READY           string = "not_ready"
+	ERRCODE_BUSY                string = "busy"
+	ERRCODE_NOT_IMPLEMENTED     string = "not_implemented"
+	ERRCODE_TIMEOUT             string = "timeout"
+	ERRCODE_BTRDB               string = "btrdb_error"
+	ERRCODE_INTERNAL            string = "internal_error"
+)
+
+// PlotterError is an error that carries the information needed to report it
+// to a client.
+type PlotterError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (pe *PlotterError) Error() string {
+	return pe.Message
+}
+
+type errorEnvelope struct {
+	Error *PlotterError `json:"error"`
+}
+
+func newPlotterError(status int, code string, format string, args ...interface{}) *PlotterError {
+	return &PlotterError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func errBadRequest(format string, args ...interface{}) *PlotterError {
+	return newPlotterError(http.StatusBadRequest, ERRCODE_BAD_REQUEST, format, args...)
+}
+
+func errInvalidToken() *PlotterError {
+	return newPlotterError(http.StatusUnauthorized, ERRCODE_INVALID_TOKEN, "Invalid or expired session token")
+}
+
+func errPermissionDenied(uu uuid.UUID) *PlotterError {
+	return newPlotterError(http.StatusForbidden, ERRCODE_PERMISSION_DENIED, "Insufficient permissions for stream %s", uu.String())
+}
+
+func errNoSuchStream(uu uuid.UUID) *PlotterError {
+	return newPlotterError(http.StatusNotFound, ERRCODE_NO_SUCH_STREAM, "Stream %s does not exist", uu.String())
+}
+
+func errTimeout() *PlotterError {
+	return newPlotterError(http.StatusGatewayTimeout, ERRCODE_TIMEOUT, "Request to BTrDB timed out")
+}
+
+/* Converts an error from a request to BTrDB made under CTX. BTrDB reports
+   an expired deadline with an error of its own, so the context is checked
+   to tell that the request timed out. */
+func btrdbError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errTimeout()
+	}
+	return err
+}
+
+/* The error returned by a reader made by http.MaxBytesReader when the limit is
+   exceeded. Its message is compared, rather than its type, since
+   *http.MaxBytesError only exists as of Go 1.19. */
+const MAX_BYTES_ERROR_MESSAGE = "http: request body too large"
+
+/* Reports a failure to read the body of a request. */
+func payloadError(err error) *PlotterError {
+	if err.Error() == MAX_BYTES_ERROR_MESSAGE {
+		return newPlotterError(http.StatusRequestEntityTooLarge, ERRCODE_TOO_LARGE, "Request body exceeds %d bytes", MAX_REQSIZE)
+	}
+	return errBadRequest("Could not read received POST payload: %v", err)
+}
+
+/* Converts an arbitrary error into a PlotterError. Errors that did not
+   originate in Mr. Plotter itself are assumed to have come from BTrDB. */
+func toPlotterError(err error) *PlotterError {
+	if pe, ok := err.(*PlotterError); ok {
+		return pe
+	}
+	if err == context.DeadlineExceeded {
+		return errTimeout()
+	}
+	return newPlotterError(http.StatusBadGateway, ERRCODE_BTRDB, "%s", err.Error())
+}
+
+/* Encodes an error response, without the HTTP status. This is used directly
+   for errors sent over a WebSocket. */
+func marshalError(err error) []byte {
+	encoded, merr := json.Marshal(errorEnvelope{Error: toPlotterError(err)})
+	if merr != nil {
+		log.Fatalf("Could not JSON-encode error response: %v", merr)
+	}
+	return encoded
+}
+
+/* Writes an error response, including its HTTP status. This must be called
+   before anything else is written to the response. */
+func writeError(w http.ResponseWriter, err error) {
+	pe := toPlotterError(err)
+	if pe.Status == http.StatusInternalServerError || pe.Code == ERRCODE_BTRDB {
+		log.Printf("Error handling request: %v", pe.Message)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(pe.Status)
+	w.Write(marshalError(pe))
+}
+
+/* Handles a failed WebSocket upgrade. */
+func writeUpgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	writeError(w, newPlotterError(status, ERRCODE_BAD_REQUEST, "Could not upgrade HTTP connection to WebSocket: %v", reason))
+}
+
+/* Writes a response to a request with the wrong method. */
+func writeMethodNotAllowed(w http.ResponseWriter, allow string, help string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, newPlotterError(http.StatusMethodNotAllowed, ERRCODE_METHOD_NOT_ALLOWED, "%s", help))
+}
@@ -0,0 +1,383 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for exports that run as background jobs. A
+   client POSTs the same request that it would send to /csv to /exportjobs,
+   and gets back the ID of a job that writes the file to the export directory.
+   The client polls /exportjobs/status?id=<id> for the progress of the job,
+   and once it is done, downloads the file from /exportjobs/download?id=<id>.
+   Downloads support HTTP range requests, so an interrupted download can be
+   resumed.
+
+   Permissions are checked when the job is submitted. The job ID is long and
+   random, so knowing it is enough to check on the job and download the file.
+   A finished file is deleted once it expires; files left over from a previous
+   run of Mr. Plotter are deleted at startup. */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BTrDB/mr-plotter/csvquery"
+)
+
+const DEFAULT_MAX_EXPORT_JOBS int = 4
+const DEFAULT_EXPORT_EXPIRY time.Duration = 24 * time.Hour
+const EXPORT_PURGE_INTERVAL time.Duration = time.Minute
+const EXPORT_JOB_ID_BYTES int = 16
+const EXPORT_FILE_PREFIX string = "mrplotter-export-"
+
+/* States of an export job. */
+const (
+	EXPORT_RUNNING string = "running"
+	EXPORT_DONE    string = "done"
+	EXPORT_FAILED  string = "failed"
+)
+
+var exportDir string
+var exportExpiry time.Duration
+var exportTimeout time.Duration
+var maxExportJobs int
+
+var exportJobs = make(map[string]*exportJob)
+var exportJobsLock sync.Mutex
+var runningExportJobs int
+
+type exportJob struct {
+	/* Updated atomically while the job runs. These are first so that they
+	   are 8-byte aligned. */
+	progress int64
+	written  int64
+
+	id     string
+	format string
+	path   string
+	start  int64
+	end    int64
+
+	lock     sync.Mutex
+	state    string
+	err      string
+	finished time.Time
+}
+
+// ExportJobStatus is the response to a request for the status of an export
+// job. Progress is the fraction of the queried time range that has been
+// written, and Expires is the time, in milliseconds since the epoch, at which
+// the finished file will be deleted.
+type ExportJobStatus struct {
+	ID       string
+	State    string
+	Progress float64
+	Bytes    int64
+	Error    string `json:",omitempty"`
+	Expires  int64  `json:",omitempty"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+/* Creates the export directory, deletes any files left in it by a previous
+   run, and starts deleting expired files. */
+func initExportJobs() error {
+	err := os.MkdirAll(exportDir, 0700)
+	if err != nil {
+		return err
+	}
+	leftover, err := filepath.Glob(filepath.Join(exportDir, EXPORT_FILE_PREFIX+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range leftover {
+		if err = os.Remove(path); err != nil {
+			log.Printf("Could not remove old export file %s: %v", path, err)
+		}
+	}
+	go purgeExportJobs(EXPORT_PURGE_INTERVAL)
+	return nil
+}
+
+func purgeExportJobs(period time.Duration) {
+	for {
+		time.Sleep(period)
+		var now = time.Now()
+		var expired = make([]*exportJob, 0)
+
+		exportJobsLock.Lock()
+		for id, job := range exportJobs {
+			job.lock.Lock()
+			if job.state != EXPORT_RUNNING && now.After(job.finished.Add(exportExpiry)) {
+				delete(exportJobs, id)
+				expired = append(expired, job)
+			}
+			job.lock.Unlock()
+		}
+		exportJobsLock.Unlock()
+
+		for _, job := range expired {
+			if err := os.Remove(job.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Could not remove expired export file %s: %v", job.path, err)
+			}
+		}
+	}
+}
+
+func (job *exportJob) status() *ExportJobStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	var status = &ExportJobStatus{
+		ID:    job.id,
+		State: job.state,
+		Bytes: atomic.LoadInt64(&job.written),
+		Error: job.err,
+	}
+	switch {
+	case job.state == EXPORT_DONE:
+		status.Progress = 1
+	case job.end > job.start:
+		status.Progress = float64(atomic.LoadInt64(&job.progress)-job.start) / float64(job.end-job.start)
+		if status.Progress < 0 {
+			status.Progress = 0
+		} else if status.Progress > 1 {
+			status.Progress = 1
+		}
+	}
+	if job.state != EXPORT_RUNNING {
+		status.Expires = job.finished.Add(exportExpiry).UnixNano() / 1000000
+	}
+	return status
+}
+
+func (job *exportJob) run(cq *csvquery.CSVQuery) {
+	var ctx context.Context
+	var cancelfunc context.CancelFunc
+	if exportTimeout >= 0 {
+		ctx, cancelfunc = context.WithTimeout(context.Background(), exportTimeout)
+	} else {
+		ctx, cancelfunc = context.WithCancel(context.Background())
+	}
+	defer cancelfunc()
+
+	cq.Progress = func(t int64) {
+		atomic.StoreInt64(&job.progress, t)
+	}
+	err := job.write(ctx, cq)
+	if err != nil {
+		log.Printf("Export job %s failed: %v", job.id, err)
+	}
+
+	job.lock.Lock()
+	if err != nil {
+		job.state = EXPORT_FAILED
+		job.err = err.Error()
+	} else {
+		job.state = EXPORT_DONE
+	}
+	job.finished = time.Now()
+	job.lock.Unlock()
+
+	exportJobsLock.Lock()
+	runningExportJobs--
+	exportJobsLock.Unlock()
+}
+
+/* Writes the file to a temporary path, and moves it into place only once it
+   is complete, so that a partial file is never served. */
+func (job *exportJob) write(ctx context.Context, cq *csvquery.CSVQuery) error {
+	var partial = job.path + ".part"
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(countingWriter{f, &job.written})
+	err = runExport(ctx, cq, job.format, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(partial, job.path)
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return err
+}
+
+func newExportJobID() (string, error) {
+	id := make([]byte, EXPORT_JOB_ID_BYTES)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+/* Looks up the job whose ID is in the query string of the request. */
+func lookupExportJob(r *http.Request) (*exportJob, error) {
+	id := r.URL.Query().Get("id")
+	exportJobsLock.Lock()
+	job, ok := exportJobs[id]
+	exportJobsLock.Unlock()
+	if !ok {
+		return nil, newPlotterError(http.StatusNotFound, ERRCODE_NOT_FOUND, "No export job with ID %s (it may have expired)", id)
+	}
+	return job, nil
+}
+
+func writeExportJobStatus(w http.ResponseWriter, status int, job *exportJob) {
+	encoded, err := json.Marshal(job.status())
+	if err != nil {
+		writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not encode job status: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(encoded)
+}
+
+func exportjobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w, "POST", "To start an export job, send the same JSON document as for a CSV file via a POST request.")
+		return
+	}
+
+	var ctx = r.Context()
+	if csvTimeout >= 0 {
+		var cancelfunc context.CancelFunc
+		ctx, cancelfunc = context.WithTimeout(ctx, csvTimeout)
+		defer cancelfunc()
+	}
+
+	cq, format, err := parseCSVRequest(ctx, w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := newExportJobID()
+	if err != nil {
+		writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not generate export job ID: %v", err))
+		return
+	}
+	ext, _ := exportFileType(format)
+	job := &exportJob{
+		progress: cq.StartTime,
+		id:       id,
+		format:   format,
+		path:     filepath.Join(exportDir, fmt.Sprintf("%s%s.%s", EXPORT_FILE_PREFIX, id, ext)),
+		start:    cq.StartTime,
+		end:      cq.EndTime,
+		state:    EXPORT_RUNNING,
+	}
+
+	exportJobsLock.Lock()
+	if runningExportJobs >= maxExportJobs {
+		exportJobsLock.Unlock()
+		writeError(w, newPlotterError(http.StatusServiceUnavailable, ERRCODE_BUSY, "Too many export jobs are running; try again later"))
+		return
+	}
+	runningExportJobs++
+	exportJobs[id] = job
+	exportJobsLock.Unlock()
+
+	go job.run(cq)
+
+	writeExportJobStatus(w, http.StatusAccepted, job)
+}
+
+func exportjobstatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w, "GET", "To check on an export job, make a GET request with the job ID in the 'id' query parameter.")
+		return
+	}
+
+	job, err := lookupExportJob(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeExportJobStatus(w, http.StatusOK, job)
+}
+
+func exportjobdownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeMethodNotAllowed(w, "GET, HEAD", "To download the file produced by an export job, make a GET request with the job ID in the 'id' query parameter.")
+		return
+	}
+
+	job, err := lookupExportJob(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job.lock.Lock()
+	state, jobErr, finished := job.state, job.err, job.finished
+	job.lock.Unlock()
+
+	switch state {
+	case EXPORT_RUNNING:
+		writeError(w, newPlotterError(http.StatusConflict, ERRCODE_NOT_READY, "Export job %s has not finished", job.id))
+		return
+	case EXPORT_FAILED:
+		writeError(w, newPlotterError(http.StatusConflict, ERRCODE_NOT_READY, "Export job %s failed: %s", job.id, jobErr))
+		return
+	}
+
+	/* An open file can still be read after it is removed, so the file
+	   expiring during the download is not a problem. */
+	f, err := os.Open(job.path)
+	if err != nil {
+		writeError(w, newPlotterError(http.StatusNotFound, ERRCODE_NOT_FOUND, "File for export job %s is no longer available", job.id))
+		return
+	}
+	defer f.Close()
+
+	ext, contentType := exportFileType(job.format)
+	w.Header().Set("Content-Disposition", "attachment; filename=data."+ext)
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", finished, f)
+}
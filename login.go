@@ -34,6 +34,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 
 	acl "github.com/BTrDB/smartgridstore/acl"
@@ -49,6 +50,9 @@ type LoginSession struct {
 	Issued   int64
 	Prefixes map[string]struct{}
 	User     string
+
+	/* Prefixes of the collections whose metadata the user may edit. */
+	WritePrefixes map[string]struct{} `json:",omitempty"`
 }
 
 func (loginsession *LoginSession) PrefixSlice() []string {
@@ -59,6 +63,20 @@ func (loginsession *LoginSession) PrefixSlice() []string {
 	return prefixlist
 }
 
+/* Checks if the user may edit the metadata of streams in the collection. This
+   requires membership in a group with the "plotter-write" capability. */
+func hasWritePermission(ls *LoginSession, collection string) bool {
+	if ls == nil {
+		return false
+	}
+	for pfx := range ls.WritePrefixes {
+		if strings.HasPrefix(collection, pfx) {
+			return true
+		}
+	}
+	return false
+}
+
 func setSessionExpiry(seconds uint64) {
 	sessionExpirySeconds = seconds
 }
@@ -123,6 +141,14 @@ func userlogin(ctx context.Context, etcdConn *etcd.Client, user string, password
 					loginsession.Prefixes[p] = struct{}{}
 				}
 			}
+			if cap == "plotter-write" {
+				if loginsession.WritePrefixes == nil {
+					loginsession.WritePrefixes = make(map[string]struct{})
+				}
+				for _, p := range g.Prefixes {
+					loginsession.WritePrefixes[p] = struct{}{}
+				}
+			}
 		}
 	}
 
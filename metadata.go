@@ -24,7 +24,7 @@ package main
 
 import (
 	"context"
-	"errors"
+	"net/http"
 	"sort"
 	"strings"
 
@@ -66,6 +66,60 @@ func streamtoleafname(ctx context.Context, s *btrdb.Stream) (string, error) {
 	return "$" + s.UUID().String(), nil
 }
 
+/* Returns the path of a stream, as displayed in the stream tree. */
+func streamtopath(ctx context.Context, s *btrdb.Stream) (string, error) {
+	collection, err := s.Collection(ctx)
+	if err != nil {
+		return "", err
+	}
+	pathfin, err := streamtoleafname(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(collection, string(btrdbSeparator), string(plotterSeparator), -1) + string(plotterSeparator) + pathfin, nil
+}
+
+/* Finds the streams in collections beginning with PREFIX (a path in the
+   stream tree) that match the tags and annotations, as for LookupStreams,
+   and that the user has permission to see. Returns the streams and their
+   paths, sorted by path. */
+func findStreams(ctx context.Context, bc *btrdb.BTrDB, ls *LoginSession, prefix string, tags map[string]*string, annotations map[string]*string) ([]*btrdb.Stream, []string, error) {
+	coll := strings.Replace(prefix, string(plotterSeparator), string(btrdbSeparator), -1)
+	matching, err := bc.LookupStreams(ctx, coll, true, tags, annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type streamWithPath struct {
+		stream *btrdb.Stream
+		path   string
+	}
+	found := make([]streamWithPath, 0, len(matching))
+	for _, s := range matching {
+		permitted, err := hasPermission(ctx, ls, s.UUID())
+		if err != nil {
+			return nil, nil, err
+		}
+		if !permitted {
+			continue
+		}
+		path, err := streamtopath(ctx, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		found = append(found, streamWithPath{s, path})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].path < found[j].path })
+
+	streams := make([]*btrdb.Stream, len(found))
+	paths := make([]string, len(found))
+	for i, f := range found {
+		streams[i] = f.stream
+		paths[i] = f.path
+	}
+	return streams, paths, nil
+}
+
 func leafnametostream(ctx context.Context, bc *btrdb.BTrDB, collection string, leafname string) (*btrdb.Stream, error) {
 	if len(leafname) != 0 && leafname[0] == '$' {
 		uuidstr := leafname[1:]
@@ -122,7 +176,7 @@ func getprefixes(ctx context.Context, ec *etcd.Client, ls *LoginSession) (map[st
 
 /* Returns a sorted slice of top level elements in the stream tree. */
 func treetopPaths(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession) ([]string, error) {
-	collections, err := bc.ListAllCollections(ctx)
+	collections, err := listCollections(ctx, bc, "")
 	if err != nil {
 		return nil, err
 	}
@@ -181,7 +235,7 @@ func treetopPaths(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *Log
 
 func treebranchPaths(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, toplevel string) ([]string, error) {
 	collprefix := toplevel + string(btrdbSeparator)
-	collections, err := bc.ListCollections(ctx, collprefix)
+	collections, err := listCollections(ctx, bc, collprefix)
 	if err != nil {
 		return nil, err
 	}
@@ -223,18 +277,14 @@ func treeleafPaths(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *Lo
 	coll := strings.Replace(branchpath, string(plotterSeparator), string(btrdbSeparator), -1)
 
 	/* Get the streams in the collection. */
-	streams, err := bc.LookupStreams(ctx, coll, false, nil, nil)
+	leafnames, err := listLeafNames(ctx, bc, coll)
 	if err != nil {
 		return nil, err
 	}
 
-	leaves := make([]string, 0, len(streams))
-	for _, stream := range streams {
+	leaves := make([]string, 0, len(leafnames))
+	for _, pathfin := range leafnames {
 		/* Formulate the path for this stream. */
-		pathfin, err := streamtoleafname(ctx, stream)
-		if err != nil {
-			return nil, err
-		}
 		path := string(plotterSeparator) + pathfin
 
 		/* Add path to return slice. */
@@ -248,16 +298,19 @@ func treeleafPaths(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *Lo
 func treeleafMetadata(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, path string) (map[string]interface{}, error) {
 	div := strings.LastIndex(path, string(plotterSeparator))
 	if div == -1 {
-		return nil, errors.New("Invalid path")
+		return nil, errBadRequest("Invalid path %s", path)
 	}
 	leafname := path[div+1:]
 	collection := strings.Replace(path[:div], string(plotterSeparator), string(btrdbSeparator), -1)
+	if entry := indexedLeaf(collection, leafname); entry != nil {
+		return uuidMetadata(ctx, ec, bc, ls, entry.uuid)
+	}
 	s, err := leafnametostream(ctx, bc, collection, leafname)
 	if err != nil {
 		return nil, err
 	}
 	if s == nil {
-		return nil, errors.New("Stream does not exist")
+		return nil, newPlotterError(http.StatusNotFound, ERRCODE_NO_SUCH_STREAM, "Stream %s does not exist", path)
 	}
 
 	uu := s.UUID()
@@ -265,42 +318,58 @@ func treeleafMetadata(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls
 }
 
 func uuidMetadata(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, uu uuid.UUID) (map[string]interface{}, error) {
+	var ann map[string]string
+	var annVersion uint64
+	var tags map[string]string
+	var path string
+
+	/* The index may still hold a stream deleted since it was refreshed, so
+	   check that the stream exists even if it is indexed. */
 	s := bc.StreamFromUUID(uu)
 	ex, err := s.Exists(ctx)
 	if err != nil {
 		return nil, err
 	}
 	if !ex {
-		return nil, errors.New("Stream does not exist")
-	}
-	if !hasPermission(ctx, ls, uu) {
-		return nil, errors.New("Need permission")
+		return nil, errNoSuchStream(uu)
 	}
-
-	ann, _, err := s.CachedAnnotations(ctx)
-	if err != nil {
+	if err = checkPermission(ctx, ls, uu); err != nil {
 		return nil, err
 	}
 
-	tags, err := s.Tags(ctx)
-	if err != nil {
-		return nil, err
-	}
+	if entry := indexedUUID(uu); entry != nil {
+		ann, annVersion, tags, path = entry.annotations, entry.annVersion, entry.tags, entry.path
+	} else {
+		ann, annVersion, err = s.CachedAnnotations(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	collection, err := s.Collection(ctx)
-	if err != nil {
-		return nil, err
+		tags, err = s.Tags(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		path, err = streamtopath(ctx, s)
+		if err != nil {
+			return nil, err
+		}
 	}
-	pathfin, err := streamtoleafname(ctx, s)
+
+	tf, err := streamTransform(ctx, uu)
 	if err != nil {
 		return nil, err
 	}
 
 	var doc = map[string]interface{}{
-		"annotations": ann,
-		"tags":        tags,
-		"path":        strings.Replace(collection, string(btrdbSeparator), string(plotterSeparator), -1) + string(plotterSeparator) + pathfin,
-		"uuid":        uu.String(),
+		"annotations":       ann,
+		"annotationVersion": annVersion,
+		"tags":              tags,
+		"path":              path,
+		"uuid":              uu.String(),
+	}
+	if tf != nil {
+		doc["transform"] = tf
 	}
 
 	return doc, nil
@@ -0,0 +1,185 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for batch metadata requests. A client POSTs
+   "<token>;<request>" to /metadatabatch, where <request> is a JSON document
+   of the form {"UUIDs": ["<uuid>", ...], "Fields": ["path", ...]}. Fields may
+   include "annotations", "tags", "path", and "collection", and defaults to all
+   of them.
+
+   The response is a JSON array with one document per requested UUID, in the
+   order requested. Each has a "uuid" field and either the requested fields or
+   an "error" field, of the same form as an error response, explaining why
+   the metadata of that stream could not be retrieved. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/pborman/uuid"
+)
+
+/* The number of streams whose metadata is looked up at once. */
+const METADATA_BATCH_CONCURRENCY = 16
+
+const METADATA_BATCH_MAX_UUIDS = 10000
+
+var metadataFields = []string{"annotations", "tags", "path", "collection"}
+
+// MetadataBatchRequest is a request for the metadata of several streams.
+type MetadataBatchRequest struct {
+	UUIDs  []string
+	Fields []string
+}
+
+/* Returns the requested FIELDS of the metadata of the stream. */
+func selectedMetadata(ctx context.Context, bc *btrdb.BTrDB, ls *LoginSession, uu uuid.UUID, fields map[string]struct{}) (map[string]interface{}, error) {
+	var ann map[string]string
+	var tags map[string]string
+	var path string
+	var collection string
+
+	/* The index may still hold a stream deleted since it was refreshed. */
+	s := bc.StreamFromUUID(uu)
+	ex, err := s.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ex {
+		return nil, errNoSuchStream(uu)
+	}
+	if err = checkPermission(ctx, ls, uu); err != nil {
+		return nil, err
+	}
+
+	if entry := indexedUUID(uu); entry != nil {
+		ann, tags, path, collection = entry.annotations, entry.tags, entry.path, entry.collection
+	} else {
+		if _, ok := fields["annotations"]; ok {
+			if ann, _, err = s.CachedAnnotations(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := fields["tags"]; ok {
+			if tags, err = s.Tags(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := fields["path"]; ok {
+			if path, err = streamtopath(ctx, s); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := fields["collection"]; ok {
+			if collection, err = s.Collection(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var doc = map[string]interface{}{"uuid": uu.String()}
+	for field := range fields {
+		switch field {
+		case "annotations":
+			doc[field] = ann
+		case "tags":
+			doc[field] = tags
+		case "path":
+			doc[field] = path
+		case "collection":
+			doc[field] = collection
+		}
+	}
+	return doc, nil
+}
+
+func batchMetadata(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, req *MetadataBatchRequest) ([]map[string]interface{}, error) {
+	if len(req.UUIDs) > METADATA_BATCH_MAX_UUIDS {
+		return nil, errBadRequest("At most %d UUIDs may be requested at once", METADATA_BATCH_MAX_UUIDS)
+	}
+
+	var fields = make(map[string]struct{})
+	if len(req.Fields) == 0 {
+		req.Fields = metadataFields
+	}
+	for _, field := range req.Fields {
+		switch field {
+		case "annotations", "tags", "path", "collection":
+			fields[field] = struct{}{}
+		default:
+			return nil, errBadRequest("Unknown metadata field %s", field)
+		}
+	}
+
+	var results = make([]map[string]interface{}, len(req.UUIDs))
+	var wg sync.WaitGroup
+	var slots = make(chan struct{}, METADATA_BATCH_CONCURRENCY)
+	for i, uuidstr := range req.UUIDs {
+		uu := uuid.Parse(uuidstr)
+		if uu == nil {
+			results[i] = map[string]interface{}{
+				"uuid":  uuidstr,
+				"error": errBadRequest("Invalid UUID: got %v", uuidstr),
+			}
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, uu uuid.UUID) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			doc, err := selectedMetadata(ctx, bc, ls, uu, fields)
+			if err != nil {
+				doc = map[string]interface{}{
+					"uuid":  uu.String(),
+					"error": toPlotterError(err),
+				}
+			}
+			results[i] = doc
+		}(i, uu)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+func metadatabatchHandler(w http.ResponseWriter, r *http.Request) {
+	mdDispatch(w, r, func(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, request string) ([]byte, error) {
+		var req MetadataBatchRequest
+		if err := json.Unmarshal([]byte(request), &req); err != nil {
+			return nil, errBadRequest("Received invalid JSON: %v", err)
+		}
+		results, err := batchMetadata(ctx, ec, bc, ls, &req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(results)
+	})
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains an in-memory index of the collections and streams in
+   BTrDB, with the metadata of each stream, so that the stream tree and
+   metadata requests can be served without listing and reading streams in
+   BTrDB; metadata requests still check that the stream exists. The index is
+   rebuilt in the background every metadataIndexInterval, from a single
+   lookup of every stream; a rebuild that takes longer than
+   metadataIndexTimeout is abandoned. Until the first rebuild completes, or if
+   the index is disabled, requests are served from BTrDB as before, and a
+   message is logged when the index becomes ready or a rebuild fails.
+
+   Responses served from the index carry the INDEX_AGE_HEADER header, giving
+   the number of seconds since the index was last refreshed, so that clients
+   know how stale the tree may be. */
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/pborman/uuid"
+)
+
+const INDEX_AGE_HEADER = "X-Metadata-Index-Age"
+const DEFAULT_METADATA_INDEX_INTERVAL = time.Minute
+const DEFAULT_METADATA_INDEX_TIMEOUT = 10 * time.Minute
+
+/* A negative interval disables the index. */
+var metadataIndexInterval time.Duration
+
+/* A negative timeout means that a rebuild of the index is never abandoned. */
+var metadataIndexTimeout time.Duration
+
+type indexedStream struct {
+	uuid        uuid.UUID
+	collection  string
+	leafname    string
+	path        string
+	tags        map[string]string
+	annotations map[string]string
+	annVersion  uint64
+}
+
+/* A snapshot of the index. It is never modified once built. */
+type metadataIndex struct {
+	refreshed time.Time
+
+	/* Sorted. */
+	collections []string
+
+	/* The streams in each collection, sorted by leaf name. */
+	streams map[string][]*indexedStream
+	byUUID  map[uuid.Array]*indexedStream
+}
+
+var mdIndexLock sync.RWMutex
+var mdIndex *metadataIndex
+
+/* Returns the current snapshot of the index, or nil if it is not ready. */
+func currentIndex() *metadataIndex {
+	mdIndexLock.RLock()
+	defer mdIndexLock.RUnlock()
+	return mdIndex
+}
+
+/* Builds a new snapshot of the index. All streams are found with a single
+   lookup, which also returns their metadata. */
+func buildMetadataIndex(ctx context.Context, bc *btrdb.BTrDB) (*metadataIndex, error) {
+	matching, err := bc.LookupStreams(ctx, "", true, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var idx = &metadataIndex{
+		refreshed: time.Now(),
+		streams:   make(map[string][]*indexedStream),
+		byUUID:    make(map[uuid.Array]*indexedStream, len(matching)),
+	}
+	for _, s := range matching {
+		coll, err := s.Collection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ann, annVersion, err := s.CachedAnnotations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := s.Tags(ctx)
+		if err != nil {
+			return nil, err
+		}
+		leafname, err := streamtoleafname(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		entry := &indexedStream{
+			uuid:        s.UUID(),
+			collection:  coll,
+			leafname:    leafname,
+			path:        indexedPath(coll, leafname),
+			tags:        tags,
+			annotations: ann,
+			annVersion:  annVersion,
+		}
+		if _, ok := idx.streams[coll]; !ok {
+			idx.collections = append(idx.collections, coll)
+		}
+		idx.streams[coll] = append(idx.streams[coll], entry)
+		idx.byUUID[entry.uuid.Array()] = entry
+	}
+
+	sort.Strings(idx.collections)
+	for _, entries := range idx.streams {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].leafname < entries[j].leafname })
+	}
+	return idx, nil
+}
+
+func indexedPath(collection string, leafname string) string {
+	return strings.Replace(collection, string(btrdbSeparator), string(plotterSeparator), -1) + string(plotterSeparator) + leafname
+}
+
+/* Returns a copy of the entry with the specified annotations. LEAFNAME is the
+   leaf name given by those annotations. */
+func (entry *indexedStream) withAnnotations(leafname string, ann map[string]string, annVersion uint64) *indexedStream {
+	var updated = *entry
+	updated.leafname = leafname
+	updated.path = indexedPath(entry.collection, leafname)
+	updated.annotations = ann
+	updated.annVersion = annVersion
+	return &updated
+}
+
+/* Returns a copy of the snapshot in which ENTRY replaces the stream with the
+   same UUID, which must be in the snapshot. */
+func (idx *metadataIndex) withStream(entry *indexedStream) *metadataIndex {
+	var updated = *idx
+	updated.byUUID = make(map[uuid.Array]*indexedStream, len(idx.byUUID))
+	for uu, old := range idx.byUUID {
+		updated.byUUID[uu] = old
+	}
+	updated.byUUID[entry.uuid.Array()] = entry
+
+	updated.streams = make(map[string][]*indexedStream, len(idx.streams))
+	for coll, entries := range idx.streams {
+		updated.streams[coll] = entries
+	}
+	entries := make([]*indexedStream, 0, len(idx.streams[entry.collection]))
+	for _, old := range idx.streams[entry.collection] {
+		if uuid.Equal(old.uuid, entry.uuid) {
+			old = entry
+		}
+		entries = append(entries, old)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].leafname < entries[j].leafname })
+	updated.streams[entry.collection] = entries
+	return &updated
+}
+
+/* Updates the indexed annotations of a stream after they are changed, so that
+   the index does not serve the old ones until the next refresh. Does nothing
+   if the stream is not in the index. */
+func updateIndexedAnnotations(uu uuid.UUID, leafname string, ann map[string]string, annVersion uint64) {
+	mdIndexLock.Lock()
+	defer mdIndexLock.Unlock()
+	if mdIndex == nil {
+		return
+	}
+	old, ok := mdIndex.byUUID[uu.Array()]
+	if !ok || old.annVersion >= annVersion {
+		return
+	}
+	mdIndex = mdIndex.withStream(old.withAnnotations(leafname, ann, annVersion))
+}
+
+/* Refreshes the index every INTERVAL, forever. A refresh that takes longer
+   than TIMEOUT is abandoned, and the previous snapshot is kept. */
+func maintainMetadataIndex(bc *btrdb.BTrDB, interval time.Duration, timeout time.Duration) {
+	log.Println("Building metadata index; metadata is served from BTrDB until it is ready")
+	for {
+		var ctx context.Context
+		var cancelfunc context.CancelFunc
+		if timeout >= 0 {
+			ctx, cancelfunc = context.WithTimeout(context.Background(), timeout)
+		} else {
+			ctx, cancelfunc = context.WithCancel(context.Background())
+		}
+		start := time.Now()
+		idx, err := buildMetadataIndex(ctx, bc)
+		cancelfunc()
+		if err != nil {
+			if old := currentIndex(); old == nil {
+				log.Printf("Metadata index is not ready; could not build it: %v", err)
+			} else {
+				log.Printf("Could not refresh metadata index (serving a snapshot from %v): %v", old.refreshed, err)
+			}
+		} else {
+			mdIndexLock.Lock()
+			if mdIndex == nil {
+				log.Printf("Metadata index is ready: %d streams in %d collections, built in %v", len(idx.byUUID), len(idx.collections), time.Since(start))
+			}
+			/* Annotations edited while the index was being rebuilt may be
+			   newer than the rebuilt ones. */
+			if mdIndex != nil {
+				for uu, edited := range mdIndex.byUUID {
+					rebuilt, ok := idx.byUUID[uu]
+					if ok && rebuilt.annVersion < edited.annVersion {
+						idx = idx.withStream(rebuilt.withAnnotations(edited.leafname, edited.annotations, edited.annVersion))
+					}
+				}
+			}
+			mdIndex = idx
+			mdIndexLock.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+/* Sets INDEX_AGE_HEADER if the index is in use. */
+func setIndexAgeHeader(w http.ResponseWriter) {
+	if idx := currentIndex(); idx != nil {
+		age := int64(time.Since(idx.refreshed) / time.Second)
+		w.Header().Set(INDEX_AGE_HEADER, strconv.FormatInt(age, 10))
+	}
+}
+
+/* Returns the collections beginning with PREFIX, from the index if it is
+   ready. */
+func listCollections(ctx context.Context, bc *btrdb.BTrDB, prefix string) ([]string, error) {
+	idx := currentIndex()
+	if idx == nil {
+		if prefix == "" {
+			return bc.ListAllCollections(ctx)
+		}
+		return bc.ListCollections(ctx, prefix)
+	}
+
+	start := sort.SearchStrings(idx.collections, prefix)
+	end := start
+	for end != len(idx.collections) && strings.HasPrefix(idx.collections[end], prefix) {
+		end++
+	}
+	return idx.collections[start:end], nil
+}
+
+/* Returns the leaf names of the streams in COLLECTION, from the index if it is
+   ready. */
+func listLeafNames(ctx context.Context, bc *btrdb.BTrDB, collection string) ([]string, error) {
+	if idx := currentIndex(); idx != nil {
+		entries := idx.streams[collection]
+		leafnames := make([]string, len(entries))
+		for i, entry := range entries {
+			leafnames[i] = entry.leafname
+		}
+		return leafnames, nil
+	}
+
+	streams, err := bc.LookupStreams(ctx, collection, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	leafnames := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		leafname, err := streamtoleafname(ctx, stream)
+		if err != nil {
+			return nil, err
+		}
+		leafnames = append(leafnames, leafname)
+	}
+	return leafnames, nil
+}
+
+/* Returns the indexed metadata of the stream in COLLECTION with the specified
+   leaf name, or nil if it is not in the index or the index is not ready. */
+func indexedLeaf(collection string, leafname string) *indexedStream {
+	idx := currentIndex()
+	if idx == nil {
+		return nil
+	}
+	entries := idx.streams[collection]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].leafname >= leafname })
+	if i == len(entries) || entries[i].leafname != leafname {
+		return nil
+	}
+	return entries[i]
+}
+
+/* Returns the indexed metadata of the stream, or nil if it is not in the index
+   or the index is not ready. */
+func indexedUUID(uu uuid.UUID) *indexedStream {
+	idx := currentIndex()
+	if idx == nil {
+		return nil
+	}
+	return idx.byUUID[uu.Array()]
+}
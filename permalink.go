@@ -26,6 +26,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 )
@@ -60,6 +61,7 @@ var STREAM_SCHEMA = map[string]map[reflect.Kind]string{
 	"stream": { reflect.String: "String", reflect.Map: "Object" },
 	"color": { reflect.String: "String", },
 	"selected": { reflect.Bool: "Boolean", },
+	"version": { reflect.Float64: "Number", },
 }
 
 var STREAM_REQUIRED = []string{ "stream" }
@@ -83,6 +85,7 @@ func validatePermalinkJSON(jsonPermalink map[string]interface{}) error {
 	var stream map[string]interface{}
 	var streams []interface{}
 	var streamcolor string
+	var streamversion float64
 	var axisint interface{}
 	var axis map[string]interface{}
 	var axes []interface{}
@@ -130,6 +133,11 @@ func validatePermalinkJSON(jsonPermalink map[string]interface{}) error {
 		if stream["stream"] == nil {
 			return fmt.Errorf("'stream' field of element at index %d of the 'streams' array is null", i)
 		}
+		if streamversion, ok = stream["version"].(float64); ok {
+			if streamversion < 0 || streamversion != math.Floor(streamversion) {
+				return fmt.Errorf("Error: stream version must be a nonnegative integer ('streams' array, index %d)", i)
+			}
+		}
 		if streamcolor, ok = stream["color"].(string); ok {
 			if len(streamcolor) != 7 || streamcolor[0] != '#' {
 				// This isn't a complete check, but I think it's good enough
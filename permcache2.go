@@ -1,7 +1,6 @@
 package main
 
 import (
-  "log"
   "strings"
 	"context"
 	"github.com/samkumar/reqcache"
@@ -14,26 +13,46 @@ type CollectionQuery struct {
 
 var permcache = reqcache.NewLRUCache(1024, queryCollection, nil)
 
-func hasPermission(ctx context.Context, session *LoginSession, uuidBytes uuid.UUID) bool {
-  checkPublicGroup()
-  coll, err := permcache.Get(ctx, CollectionQuery{uu: uuidBytes.Array()})
-  if err != nil {
-    log.Fatalf("error getting from permcache: %v", err)
-  }
-  if session == nil {
+/* Checks whether the session (nil for the public group) may view the stream.
+   If the stream's collection cannot be looked up, the error is returned: it
+   is errNoSuchStream if the stream does not exist. */
+func hasPermission(ctx context.Context, session *LoginSession, uuidBytes uuid.UUID) (bool, error) {
+	checkPublicGroup()
+	coll, err := permcache.Get(ctx, CollectionQuery{uu: uuidBytes.Array()})
+	if err != nil {
+		exists, eerr := btrdbConn.StreamFromUUID(uuidBytes).Exists(ctx)
+		if eerr == nil && !exists {
+			return false, errNoSuchStream(uuidBytes)
+		}
+		return false, btrdbError(ctx, err)
+	}
+	if session == nil {
 		for _, p := range publicGroup.Prefixes {
 			if strings.HasPrefix(coll.(string), p) {
-        return true
-      }
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	for pfx, _ := range session.Prefixes {
+		if strings.HasPrefix(coll.(string), pfx) {
+			return true, nil
 		}
-		return false
 	}
-  for pfx, _ := range session.Prefixes {
-    if strings.HasPrefix(coll.(string), pfx) {
-      return true
-    }
-  }
-  return false
+	return false, nil
+}
+
+/* Returns nil if the session may view the stream, and otherwise the error to
+   report. */
+func checkPermission(ctx context.Context, session *LoginSession, uuidBytes uuid.UUID) error {
+	permitted, err := hasPermission(ctx, session, uuidBytes)
+	if err != nil {
+		return err
+	}
+	if !permitted {
+		return errPermissionDenied(uuidBytes)
+	}
+	return nil
 }
 
 func queryCollection(ctx context.Context, key interface{}) (interface{}, uint64, error) {
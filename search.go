@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for searching the stream tree. A client POSTs
+   "<token>;<request>" to /search, where <request> is a JSON document of the
+   form {"Text": "phase A voltage substation 12", "Collection": "...",
+   "Tags": {...}, "Annotations": {...}, "Offset": 0, "Limit": 100}.
+
+   Collection, Tags, and Annotations restrict the search as for LookupStreams.
+   Text is split into words. A word of the form key=value matches streams
+   with a tag or annotation with that key and value; any other word matches
+   streams whose path, tags, or annotations contain it, ignoring case. A stream
+   must match every word. Matches are sorted by path, and Offset and Limit
+   select a page of them. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+const SEARCH_DEFAULT_LIMIT = 100
+const SEARCH_MAX_LIMIT = 1000
+
+// SearchRequest describes a search of the stream tree.
+type SearchRequest struct {
+	Text        string
+	Collection  string
+	Tags        map[string]*string
+	Annotations map[string]*string
+	Offset      int
+	Limit       int
+}
+
+// SearchResult is a stream that matches a search.
+type SearchResult struct {
+	Path string
+	UUID string
+}
+
+// SearchResponse is a page of the results of a search. Total is the number of
+// streams that match the search, across all pages.
+type SearchResponse struct {
+	Total   int
+	Offset  int
+	Results []SearchResult
+}
+
+/* A word of a search. If key is not empty, it is a key=value filter;
+   otherwise, text is matched case-insensitively. */
+type searchTerm struct {
+	key   string
+	value string
+	text  string
+}
+
+func parseSearchText(text string) []searchTerm {
+	var words = strings.Fields(text)
+	var terms = make([]searchTerm, len(words))
+	for i, word := range words {
+		if eq := strings.IndexByte(word, '='); eq > 0 {
+			terms[i].key = word[:eq]
+			terms[i].value = word[eq+1:]
+		} else {
+			terms[i].text = strings.ToLower(word)
+		}
+	}
+	return terms
+}
+
+/* Checks if a stream, with the specified path, tags, and annotations, matches
+   every term. */
+func matchesSearch(terms []searchTerm, path string, tags map[string]string, ann map[string]string) bool {
+	var lowered []string
+	for _, term := range terms {
+		if term.key != "" {
+			if tags[term.key] != term.value && ann[term.key] != term.value {
+				return false
+			}
+			continue
+		}
+
+		if lowered == nil {
+			lowered = make([]string, 0, 1+len(tags)+len(ann))
+			lowered = append(lowered, strings.ToLower(path))
+			for _, v := range tags {
+				lowered = append(lowered, strings.ToLower(v))
+			}
+			for _, v := range ann {
+				lowered = append(lowered, strings.ToLower(v))
+			}
+		}
+		found := false
+		for _, s := range lowered {
+			if strings.Contains(s, term.text) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/* Returns the collection prefixes to look up so that only streams in
+   COLLECTION (a collection prefix) that the user may see are found. */
+func searchCollections(collection string, prefixes map[string]struct{}) []string {
+	var colls = make([]string, 0, len(prefixes))
+	for pfx := range prefixes {
+		if strings.HasPrefix(collection, pfx) {
+			/* Every stream in the collection is visible. */
+			return []string{collection}
+		}
+		if strings.HasPrefix(pfx, collection) {
+			colls = append(colls, pfx)
+		}
+	}
+	return colls
+}
+
+func searchStreams(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, req *SearchRequest) (*SearchResponse, error) {
+	if req.Offset < 0 {
+		return nil, errBadRequest("Invalid offset %d", req.Offset)
+	}
+	if req.Limit == 0 {
+		req.Limit = SEARCH_DEFAULT_LIMIT
+	} else if req.Limit < 0 || req.Limit > SEARCH_MAX_LIMIT {
+		return nil, errBadRequest("Limit must be between 1 and %d", SEARCH_MAX_LIMIT)
+	}
+
+	prefixes, err := getprefixes(ctx, ec, ls)
+	if err != nil {
+		return nil, err
+	}
+
+	var terms = parseSearchText(req.Text)
+	var collection = strings.Replace(req.Collection, string(plotterSeparator), string(btrdbSeparator), -1)
+	var seen = make(map[string]struct{})
+	var results = make([]SearchResult, 0)
+	for _, coll := range searchCollections(collection, prefixes) {
+		matching, err := bc.LookupStreams(ctx, coll, true, req.Tags, req.Annotations)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range matching {
+			/* The prefixes may overlap, so a stream may be found twice. */
+			uustr := s.UUID().String()
+			if _, ok := seen[uustr]; ok {
+				continue
+			}
+			seen[uustr] = struct{}{}
+
+			path, err := streamtopath(ctx, s)
+			if err != nil {
+				return nil, err
+			}
+			tags, err := s.Tags(ctx)
+			if err != nil {
+				return nil, err
+			}
+			ann, _, err := s.CachedAnnotations(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if matchesSearch(terms, path, tags, ann) {
+				results = append(results, SearchResult{Path: path, UUID: uustr})
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+
+	var resp = &SearchResponse{Total: len(results), Offset: req.Offset}
+	if req.Offset < len(results) {
+		results = results[req.Offset:]
+		if len(results) > req.Limit {
+			results = results[:req.Limit]
+		}
+		resp.Results = results
+	} else {
+		resp.Results = []SearchResult{}
+	}
+	return resp, nil
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	mdDispatch(w, r, func(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, request string) ([]byte, error) {
+		var req SearchRequest
+		if err := json.Unmarshal([]byte(request), &req); err != nil {
+			return nil, errBadRequest("Received invalid JSON: %v", err)
+		}
+		resp, err := searchStreams(ctx, ec, bc, ls, &req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	})
+}
@@ -33,9 +33,11 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -51,6 +53,7 @@ import (
 	"github.com/BTrDB/mr-plotter/csvquery"
 	"github.com/BTrDB/mr-plotter/keys"
 	"github.com/BTrDB/mr-plotter/permalink"
+	"github.com/BTrDB/mr-plotter/transform"
 
 	etcd "github.com/coreos/etcd/clientv3"
 	httpHandlers "github.com/gorilla/handlers"
@@ -63,9 +66,24 @@ const (
 	MAX_REQSIZE         int64  = (16 << 10) // 16 KiB
 	SUCCESS             string = "Success"
 	ERROR_INVALID_TOKEN string = "Invalid token"
+	BINARY_SUBPROTOCOL  string = "mrplotter.binary"
+	BATCH_SEPARATOR     string = ";"
+	VERSION_SEPARATOR   string = "@"
+	VERSION_HEADER      string = "X-Stream-Version"
+	RAW_POINTWIDTH      string = "raw"
+
+	WINDOW_PREFIX          string = "w"
+	WINDOW_DEPTH_SEPARATOR string = ":"
+
+	DEFAULT_DATA_REQUESTS_PER_CONN uint32 = 8
+	DEFAULT_MAX_RAW_POINTS         uint64 = 100000
 )
 
-var upgrader = ws.Upgrader{}
+var upgrader = ws.Upgrader{Error: writeUpgradeError}
+
+/* Clients of /dataws that request the binary subprotocol receive data in
+   BinaryDataFormat; all other clients receive data in TextDataFormat. */
+var dataUpgrader = ws.Upgrader{Subprotocols: []string{BINARY_SUBPROTOCOL}, Error: writeUpgradeError}
 
 type RespWrapper struct {
 	wr io.Writer
@@ -88,6 +106,8 @@ var csvTimeout time.Duration
 var mdTimeout time.Duration
 var permalinkNumBytes int
 var permalinkMaxTries int
+var dataRequestsPerConn uint32
+var maxRawPoints uint64
 
 /* I don't order these elements from largest to smallest, so the int64s at the
    bottom may not be 8-byte aligned. That's OK, because I don't anticipate
@@ -110,7 +130,10 @@ type Config struct {
 	NumBracketConn          uint16
 	MaxDataRequests         uint32
 	MaxBracketRequests      uint32
+	MaxDataRequestsPerConn  uint32
 	MaxCachedTagPermissions uint64
+	DataCacheBytes          uint64
+	MaxRawPoints            uint64
 
 	PermalinkNumBytes int
 	PermalinkMaxTries int
@@ -124,6 +147,16 @@ type Config struct {
 	DbBracketTimeoutSeconds       int64
 	DbCsvTimeoutSeconds           int64
 	DbMetadataTimeoutSeconds      int64
+
+	MetadataIndexIntervalSeconds int64
+	MetadataIndexTimeoutSeconds  int64
+
+	SubscriptionPollIntervalMillis int64
+
+	ExportDir            string
+	MaxExportJobs        int
+	ExportExpirySeconds  int64
+	ExportTimeoutSeconds int64
 }
 
 var configRequiredKeys = map[string]bool{
@@ -141,7 +174,10 @@ var configRequiredKeys = map[string]bool{
 	"btrdb_endpoints":            false,
 	"max_data_requests":          true,
 	"max_bracket_requests":       true,
+	"max_data_requests_per_conn": false,
 	"max_cached_tag_permissions": true,
+	"data_cache_bytes":           false,
+	"max_raw_points":             false,
 
 	"permalink_num_bytes": true,
 	"permalink_max_tries": true,
@@ -155,6 +191,16 @@ var configRequiredKeys = map[string]bool{
 	"db_bracket_timeout_seconds":       true,
 	"db_csv_timeout_seconds":           true,
 	"db_metadata_timeout_seconds":      true,
+
+	"metadata_index_interval_seconds": false,
+	"metadata_index_timeout_seconds":  false,
+
+	"subscription_poll_interval_millis": false,
+
+	"export_dir":             false,
+	"max_export_jobs":        false,
+	"export_expiry_seconds":  false,
+	"export_timeout_seconds": false,
 }
 
 func getEtcdKeySafe(ctx context.Context, key string) []byte {
@@ -287,6 +333,7 @@ func main() {
 	accounts.SetEtcdKeyPrefix(etcdPrefix)
 	keys.SetEtcdKeyPrefix(etcdPrefix)
 	permalink.SetEtcdKeyPrefix(etcdPrefix)
+	transform.SetEtcdKeyPrefix(etcdPrefix)
 
 	var etcdEndpoint = os.Getenv("ETCD_ENDPOINT")
 	if len(etcdEndpoint) == 0 {
@@ -426,15 +473,63 @@ func main() {
 	}
 	log.Println("BTrDB is OK!")
 
-	dr = NewDataRequester(btrdbConn, config.MaxDataRequests)
+	dr = NewDataRequester(btrdbConn, config.MaxDataRequests, config.DataCacheBytes)
 	if dr == nil {
 		os.Exit(1)
 	}
-	br = NewDataRequester(btrdbConn, config.MaxBracketRequests)
+	br = NewDataRequester(btrdbConn, config.MaxBracketRequests, 0)
 	if br == nil {
 		os.Exit(1)
 	}
 
+	dataRequestsPerConn = config.MaxDataRequestsPerConn
+	if dataRequestsPerConn == 0 {
+		dataRequestsPerConn = DEFAULT_DATA_REQUESTS_PER_CONN
+	}
+
+	maxRawPoints = config.MaxRawPoints
+	if maxRawPoints == 0 {
+		maxRawPoints = DEFAULT_MAX_RAW_POINTS
+	}
+
+	subscriptionPollInterval = time.Duration(config.SubscriptionPollIntervalMillis) * time.Millisecond
+	if subscriptionPollInterval <= 0 {
+		subscriptionPollInterval = DEFAULT_SUBSCRIPTION_POLL_INTERVAL
+	}
+
+	exportDir = config.ExportDir
+	if exportDir == "" {
+		exportDir = filepath.Join(os.TempDir(), "mr-plotter-exports")
+	}
+	maxExportJobs = config.MaxExportJobs
+	if maxExportJobs <= 0 {
+		maxExportJobs = DEFAULT_MAX_EXPORT_JOBS
+	}
+	exportExpiry = time.Duration(config.ExportExpirySeconds) * time.Second
+	if exportExpiry <= 0 {
+		exportExpiry = DEFAULT_EXPORT_EXPIRY
+	}
+	exportTimeout = time.Duration(config.ExportTimeoutSeconds) * time.Second
+	if config.ExportTimeoutSeconds == 0 {
+		exportTimeout = -1
+	}
+	err = initExportJobs()
+	if err != nil {
+		log.Fatalf("Could not set up export directory %s: %v", exportDir, err)
+	}
+
+	metadataIndexInterval = time.Duration(config.MetadataIndexIntervalSeconds) * time.Second
+	if metadataIndexInterval == 0 {
+		metadataIndexInterval = DEFAULT_METADATA_INDEX_INTERVAL
+	}
+	metadataIndexTimeout = time.Duration(config.MetadataIndexTimeoutSeconds) * time.Second
+	if metadataIndexTimeout == 0 {
+		metadataIndexTimeout = DEFAULT_METADATA_INDEX_TIMEOUT
+	}
+	if metadataIndexInterval > 0 {
+		go maintainMetadataIndex(btrdbConn, metadataIndexInterval, metadataIndexTimeout)
+	}
+
 	setSessionExpiry(config.SessionExpirySeconds)
 
 	go logWaitingRequests(time.Duration(config.OutstandingRequestLogInterval) * time.Second)
@@ -451,13 +546,23 @@ func main() {
 	http.HandleFunc("/data", dataHandler)
 	http.HandleFunc("/bracketws", bracketwsHandler)
 	http.HandleFunc("/bracket", bracketHandler)
+	http.HandleFunc("/subscribews", subscribewsHandler)
+	http.HandleFunc("/changes", changesHandler)
+	http.HandleFunc("/statistics", statisticsHandler)
 	http.HandleFunc("/treetop", treetopHandler)
 	http.HandleFunc("/treebranch", treebranchHandler)
 	http.HandleFunc("/treeleaf", treeleafHandler)
 	http.HandleFunc("/metadataleaf", metadataleafHandler)
 	http.HandleFunc("/metadatauuid", metadatauuidHandler)
+	http.HandleFunc("/metadatabatch", metadatabatchHandler)
+	http.HandleFunc("/editmetadata", editmetadataHandler)
+	http.HandleFunc("/search", searchHandler)
 	http.HandleFunc("/permalink", permalinkHandler)
+	http.HandleFunc("/transform", transformHandler)
 	http.HandleFunc("/csv", csvHandler)
+	http.HandleFunc("/exportjobs", exportjobsHandler)
+	http.HandleFunc("/exportjobs/status", exportjobstatusHandler)
+	http.HandleFunc("/exportjobs/download", exportjobdownloadHandler)
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/logoff", logoffHandler)
 	http.HandleFunc("/changepw", changepwHandler)
@@ -523,16 +628,21 @@ func logNumGoroutines(period time.Duration) {
 	}
 }
 
-func parseDataRequest(request string, writ Writable) (uuidBytes uuid.UUID, startTime int64, endTime int64, pw uint8, extra1 string, extra2 string, success bool) {
+/* The first argument of a data request may list several UUIDs separated by
+   BATCH_SEPARATOR; the remaining arguments apply to every stream listed. Each
+   UUID may be followed by VERSION_SEPARATOR and the version of the stream to
+   query; streams without a version are queried at their latest version.
+
+   The fourth argument specifies the kind of query. It may be a point width
+   exponent, for an aligned windows query; RAW_POINTWIDTH, for the raw values
+   in the time range; or WINDOW_PREFIX followed by a window size in
+   nanoseconds and optionally WINDOW_DEPTH_SEPARATOR and a depth, for a windows
+   query starting exactly at the start time. */
+func parseDataRequest(request string) (q *DataQuery, extra1 string, extra2 string, err error) {
 	var args []string = strings.Split(string(request), ",")
-	var err error
-
-	success = false
-	var w io.Writer
 
 	if len(args) != 4 && len(args) != 5 && len(args) != 6 {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Four, five, or six arguments are required; got %v", len(args))))
+		err = errBadRequest("Four, five, or six arguments are required; got %v", len(args))
 		return
 	}
 
@@ -543,52 +653,108 @@ func parseDataRequest(request string, writ Writable) (uuidBytes uuid.UUID, start
 		extra1 = args[4]
 	}
 
-	uuidBytes = uuid.Parse(args[0])
+	var uuidstrs []string = strings.Split(args[0], BATCH_SEPARATOR)
+	q = &DataQuery{
+		UUIDs:          make([]uuid.UUID, len(uuidstrs)),
+		Versions:       make([]uint64, len(uuidstrs)),
+		ReportVersions: len(uuidstrs) != 1,
+	}
+	var pwTemp int64
+	var perr error
+	for i, uuidstr := range uuidstrs {
+		if strings.HasPrefix(uuidstr, DERIVED_PREFIX) {
+			if q.Derived == nil {
+				q.Derived = make([]*DerivedQuery, len(uuidstrs))
+			}
+			q.Derived[i], err = parseDerivedID(uuidstr)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if sep := strings.Index(uuidstr, VERSION_SEPARATOR); sep != -1 {
+			q.Versions[i], perr = strconv.ParseUint(uuidstr[sep+1:], 10, 64)
+			if perr != nil {
+				err = errBadRequest("Could not interpret %v as a version number: %v", uuidstr[sep+1:], perr)
+				return
+			}
+			uuidstr = uuidstr[:sep]
+			q.ReportVersions = true
+		}
+		q.UUIDs[i] = uuid.Parse(uuidstr)
+		if q.UUIDs[i] == nil {
+			err = errBadRequest("Invalid UUID: got %v", uuidstr)
+			return
+		}
+	}
 
-	if uuidBytes == nil {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Invalid UUID: got %v", args[0])))
+	q.StartTime, perr = strconv.ParseInt(args[1], 10, 64)
+	if perr != nil {
+		err = errBadRequest("Could not interpret %v as an int64: %v", args[1], perr)
 		return
 	}
-	var pwTemp int64
 
-	startTime, err = strconv.ParseInt(args[1], 10, 64)
-	if err != nil {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Could not interpret %v as an int64: %v", args[1], err)))
+	q.EndTime, perr = strconv.ParseInt(args[2], 10, 64)
+	if perr != nil {
+		err = errBadRequest("Could not interpret %v as an int64: %v", args[2], perr)
 		return
 	}
 
-	endTime, err = strconv.ParseInt(args[2], 10, 64)
-	if err != nil {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Could not interpret %v as an int64: %v", args[2], err)))
+	if args[3] == RAW_POINTWIDTH {
+		q.Raw = true
+		if q.EndTime != math.MaxInt64 {
+			q.EndTime++ // we add one nanosecond to the endtime to simulate an inclusive endpoint
+		}
 		return
 	}
 
-	pwTemp, err = strconv.ParseInt(args[3], 10, 16)
-	if err != nil {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Could not interpret %v as an int16: %v", args[3], err)))
+	if strings.HasPrefix(args[3], WINDOW_PREFIX) {
+		var windowstr = args[3][len(WINDOW_PREFIX):]
+		var depthstr = "0"
+		if sep := strings.Index(windowstr, WINDOW_DEPTH_SEPARATOR); sep != -1 {
+			depthstr = windowstr[sep+1:]
+			windowstr = windowstr[:sep]
+		}
+		var windowSize int64
+		windowSize, perr = strconv.ParseInt(windowstr, 10, 64)
+		if perr != nil || windowSize <= 0 {
+			err = errBadRequest("Invalid window size %v", windowstr)
+			return
+		}
+		q.WindowSize = uint64(windowSize)
+		pwTemp, perr = strconv.ParseInt(depthstr, 10, 8)
+		if perr != nil || pwTemp < 0 || pwTemp > 62 {
+			err = errBadRequest("Invalid depth %v", depthstr)
+			return
+		}
+		q.PointWidth = uint8(pwTemp)
+		// we add one window to the endtime to simulate an inclusive endpoint
+		if q.EndTime > math.MaxInt64-windowSize {
+			q.EndTime = math.MaxInt64
+		} else {
+			q.EndTime += windowSize
+		}
 		return
 	}
 
-	pw = uint8(pwTemp)
+	pwTemp, perr = strconv.ParseInt(args[3], 10, 16)
+	if perr != nil {
+		err = errBadRequest("Could not interpret %v as an int16: %v", args[3], perr)
+		return
+	}
 
-	startTime = ((startTime >> pw) << pw)
-	endTime = (((endTime >> pw) + 1) << pw) // we add one pointwidth to the endtime to simulate an inclusive endpoint
+	var pw = uint8(pwTemp)
+	q.PointWidth = pw
 
-	success = true
+	q.StartTime = ((q.StartTime >> pw) << pw)
+	q.EndTime = (((q.EndTime >> pw) + 1) << pw) // we add one pointwidth to the endtime to simulate an inclusive endpoint
 
 	return
 }
 
-func parseBracketRequest(request string, writ Writable, expectExtra bool) (uuids []uuid.UUID, token string, extra string, success bool) {
+func parseBracketRequest(request string, expectExtra bool) (uuids []uuid.UUID, token string, extra string, err error) {
 	var args []string = strings.Split(string(request), ",")
 
-	success = false
-	var w io.Writer
-
 	var numUUIDs int
 
 	if expectExtra {
@@ -598,8 +764,7 @@ func parseBracketRequest(request string, writ Writable, expectExtra bool) (uuids
 	}
 
 	if numUUIDs < 1 {
-		w = writ.GetWriter()
-		w.Write([]byte(fmt.Sprintf("Got only %v arguments", len(args))))
+		err = errBadRequest("Got only %v arguments", len(args))
 		return
 	}
 
@@ -612,16 +777,13 @@ func parseBracketRequest(request string, writ Writable, expectExtra bool) (uuids
 	for i := 0; i < numUUIDs; i++ {
 		uuids[i] = uuid.Parse(args[i])
 		if uuids[i] == nil {
-			w = writ.GetWriter()
-			w.Write([]byte(fmt.Sprintf("Received invalid UUID %v", args[i])))
+			err = errBadRequest("Received invalid UUID %v", args[i])
 			return
 		}
 	}
 
 	token = args[numUUIDs]
 
-	success = true
-
 	return
 }
 
@@ -633,119 +795,234 @@ func validateToken(token string) *LoginSession {
 	return getloginsession(tokenslice)
 }
 
+/* Returns the login session for a token sent by the client. An empty token
+   means that the client is not logged in, in which case the session is nil. */
+func sessionFromToken(token string) (*LoginSession, error) {
+	if token == "" {
+		return nil, nil
+	}
+	loginsession := validateToken(token)
+	if loginsession == nil {
+		return nil, errInvalidToken()
+	}
+	return loginsession, nil
+}
+
 func datawsHandler(w http.ResponseWriter, r *http.Request) {
 	var websocket *ws.Conn
 	var upgradeerr error
-	websocket, upgradeerr = upgrader.Upgrade(w, r, nil)
+	websocket, upgradeerr = dataUpgrader.Upgrade(w, r, nil)
 	if upgradeerr != nil {
-		w.Write([]byte(fmt.Sprintf("Could not upgrade HTTP connection to WebSocket: %v\n", upgradeerr)))
-		return
+		return // The upgrader has already replied with an error
 	}
 
 	cw := ConnWrapper{
-		Writing: &sync.Mutex{},
-		Conn:    websocket,
+		Writing:     &sync.Mutex{},
+		Conn:        websocket,
+		MessageType: ws.TextMessage,
+	}
+
+	var format = TextDataFormat
+	if websocket.Subprotocol() == BINARY_SUBPROTOCOL {
+		format = BinaryDataFormat
+		cw.MessageType = ws.BinaryMessage
 	}
 
 	websocket.SetReadLimit(MAX_REQSIZE)
 
+	/* Requests on the same WebSocket are handled concurrently, up to a limit
+	   of dataRequestsPerConn at a time. Each response is buffered and written
+	   out together with its echo tag, so responses may complete in any order.
+	   When the client closes the socket, in-flight requests are cancelled. */
+	connctx, conncancel := context.WithCancel(r.Context())
+	var inflight sync.WaitGroup
+	var slots = make(chan struct{}, dataRequestsPerConn)
+	defer func() {
+		conncancel()
+		inflight.Wait()
+		websocket.Close()
+	}()
+
+	/* The socket is read in its own goroutine, so that a disconnect is noticed
+	   even while every slot is busy. */
+	var messages = make(chan []byte)
+	go func() {
+		defer conncancel()
+		for {
+			_, payload, err := websocket.ReadMessage()
+			if err != nil {
+				return // Most likely the connection was closed or the message was too big
+			}
+			select {
+			case messages <- payload:
+			case <-connctx.Done():
+				return
+			}
+		}
+	}()
+
 	for {
-		_, payload, err := websocket.ReadMessage()
+		var payload []byte
+		select {
+		case payload = <-messages:
+		case <-connctx.Done():
+			return
+		}
 
+		q, token, echoTag, err := parseDataRequest(string(payload))
 		if err != nil {
-			return // Most likely the connection was closed or the message was too big
+			cw.WriteError(err, echoTag)
+			continue
 		}
 
-		uuidBytes, startTime, endTime, pw, token, echoTag, success := parseDataRequest(string(payload), &cw)
+		loginsession, err := sessionFromToken(token)
+		if err != nil {
+			cw.WriteError(err, echoTag)
+			continue
+		}
 
-		if success {
-			var loginsession *LoginSession
-			if token != "" {
-				loginsession = validateToken(token)
-				if loginsession == nil {
-					w.Write([]byte(ERROR_INVALID_TOKEN))
-					return
+		select {
+		case slots <- struct{}{}:
+		case <-connctx.Done():
+			return
+		}
+		inflight.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				inflight.Done()
+			}()
+
+			/* A batch request gets one response per stream, each followed by
+			   the echo tag and the UUID of the stream, separated by a comma.
+			   For a batch request, or one that pins a version, the tag
+			   following a successful response is further followed by a comma
+			   and the version of the stream that was served. */
+			for i := range q.UUIDs {
+				var resp bytes.Buffer
+				var ctx context.Context
+				var cancelfunc context.CancelFunc
+				if dataTimeout >= 0 {
+					ctx, cancelfunc = context.WithTimeout(connctx, dataTimeout)
+				} else {
+					ctx, cancelfunc = context.WithCancel(connctx)
+				}
+				var version uint64
+				var err = q.checkPermission(ctx, loginsession, i)
+				if err == nil {
+					version, err = dr.MakeQuery(ctx, q, i, format, RespWrapper{&resp})
 				}
-			}
-			var ctx = r.Context()
-			var cancelfunc context.CancelFunc
-			if dataTimeout >= 0 {
-				ctx, cancelfunc = context.WithTimeout(ctx, dataTimeout)
-			} else {
-				ctx, cancelfunc = context.WithCancel(ctx)
-			}
-			if hasPermission(ctx, loginsession, uuidBytes) {
-				dr.MakeDataRequest(ctx, uuidBytes, startTime, endTime, uint8(pw), &cw)
-				cancelfunc()
-			} else {
 				cancelfunc()
-				cw.GetWriter().Write([]byte("[]"))
+
+				if connctx.Err() != nil {
+					return
+				}
+
+				var tag = echoTag
+				if len(q.UUIDs) != 1 {
+					tag = echoTag + "," + q.streamID(i)
+				}
+				if err != nil {
+					err = cw.WriteError(err, tag)
+				} else {
+					if q.ReportVersions {
+						tag += "," + strconv.FormatUint(version, 10)
+					}
+					err = cw.WriteResponse(resp.Bytes(), tag)
+				}
+				if err != nil {
+					log.Printf("Could not write data response to client: %v", err)
+					conncancel()
+					return
+				}
 			}
-		}
-		if cw.CurrWriter != nil {
-			cw.CurrWriter.Close()
-		}
+		}()
+	}
+}
+
+/* Finishes the message being written to the WebSocket, follows it with a
+   message containing the echo tag, and releases the WebSocket for writing. */
+func finishWebSocketResponse(cw *ConnWrapper, echoTag string) {
+	if cw.CurrWriter != nil {
+		cw.CurrWriter.Close()
+	}
+
+	writer, err := cw.Conn.NextWriter(ws.TextMessage)
+	if err != nil {
+		log.Printf("Could not echo tag to client: %v", err)
+	}
 
-		writer, err := websocket.NextWriter(ws.TextMessage)
+	if cw.CurrWriter != nil {
+		_, err = writer.Write([]byte(echoTag))
 		if err != nil {
 			log.Printf("Could not echo tag to client: %v", err)
 		}
-
-		if cw.CurrWriter != nil {
-			_, err = writer.Write([]byte(echoTag))
-			if err != nil {
-				log.Printf("Could not echo tag to client: %v", err)
-			}
-			writer.Close()
-		}
-
-		cw.Writing.Unlock()
+		writer.Close()
 	}
+
+	cw.Writing.Unlock()
 }
 
 func dataHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("You must send a POST request to get data."))
+	if onlyallowpost(w, r) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQSIZE)
-	payload, err := ioutil.ReadAll(r.Body)
+	payload, ok := readfullbody(w, r)
+	if !ok {
+		return
+	}
+
+	format, ok := parseDataFormat(r.URL.Query().Get("format"))
+	if !ok {
+		writeError(w, errBadRequest("Unknown data format %s", r.URL.Query().Get("format")))
+		return
+	}
+
+	q, token, _, err := parseDataRequest(string(payload))
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		writeError(w, err)
 		return
 	}
 
-	var wrapper = RespWrapper{w}
+	if len(q.UUIDs) != 1 {
+		writeError(w, errBadRequest("Batch requests are only supported over WebSockets"))
+		return
+	}
 
-	uuidBytes, startTime, endTime, pw, token, _, success := parseDataRequest(string(payload), wrapper)
+	loginsession, err := sessionFromToken(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var ctx = r.Context()
+	var cancelfunc context.CancelFunc
+	if dataTimeout >= 0 {
+		ctx, cancelfunc = context.WithTimeout(ctx, dataTimeout)
+	} else {
+		ctx, cancelfunc = context.WithCancel(ctx)
+	}
+	defer cancelfunc()
 
-	if success {
-		var loginsession *LoginSession
-		if token != "" {
-			loginsession = validateToken(token)
-			if loginsession == nil {
-				w.Write([]byte(ERROR_INVALID_TOKEN))
-				return
-			}
-		}
-		var ctx = r.Context()
-		var cancelfunc context.CancelFunc
-		if dataTimeout >= 0 {
-			ctx, cancelfunc = context.WithTimeout(ctx, dataTimeout)
-		} else {
-			ctx, cancelfunc = context.WithCancel(ctx)
-		}
-		if hasPermission(ctx, loginsession, uuidBytes) {
-			dr.MakeDataRequest(ctx, uuidBytes, startTime, endTime, uint8(pw), wrapper)
-			cancelfunc()
-		} else {
-			cancelfunc()
-			wrapper.GetWriter().Write([]byte("[]"))
-		}
+	if err = q.checkPermission(ctx, loginsession, 0); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	/* Buffer the response, so that we can still report an error if the query
+	   fails partway through. */
+	var resp bytes.Buffer
+	version, err := dr.MakeQuery(ctx, q, 0, format, RespWrapper{&resp})
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+
+	w.Header().Set(VERSION_HEADER, strconv.FormatUint(version, 10))
+	if format == BinaryDataFormat {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Write(resp.Bytes())
 }
 
 func bracketwsHandler(w http.ResponseWriter, r *http.Request) {
@@ -753,13 +1030,13 @@ func bracketwsHandler(w http.ResponseWriter, r *http.Request) {
 	var upgradeerr error
 	websocket, upgradeerr = upgrader.Upgrade(w, r, nil)
 	if upgradeerr != nil {
-		w.Write([]byte(fmt.Sprintf("Could not upgrade HTTP connection to WebSocket: %v\n", upgradeerr)))
-		return
+		return // The upgrader has already replied with an error
 	}
 
 	cw := ConnWrapper{
-		Writing: &sync.Mutex{},
-		Conn:    websocket,
+		Writing:     &sync.Mutex{},
+		Conn:        websocket,
+		MessageType: ws.TextMessage,
 	}
 
 	websocket.SetReadLimit(MAX_REQSIZE)
@@ -771,107 +1048,172 @@ func bracketwsHandler(w http.ResponseWriter, r *http.Request) {
 			return // Most likely the connection was closed or the message was too big
 		}
 
-		uuids, token, echoTag, success := parseBracketRequest(string(payload), &cw, true)
-
-		if success {
-			var loginsession *LoginSession
-			if token != "" {
-				loginsession = validateToken(token)
-				if loginsession == nil {
-					w.Write([]byte(ERROR_INVALID_TOKEN))
-					return
-				}
-			}
-			var viewable []uuid.UUID = uuids[:0]
-			var ctx = r.Context()
-			var cancelfunc context.CancelFunc
-			if bracketTimeout >= 0 {
-				ctx, cancelfunc = context.WithTimeout(ctx, bracketTimeout)
-			} else {
-				ctx, cancelfunc = context.WithCancel(ctx)
-			}
-			for _, uuid := range uuids {
-				if hasPermission(ctx, loginsession, uuid) {
-					viewable = append(viewable, uuid)
-				}
-			}
-			br.MakeBracketRequest(ctx, uuids, &cw)
-			cancelfunc()
-		}
-		if cw.CurrWriter != nil {
-			cw.CurrWriter.Close()
+		uuids, token, echoTag, err := parseBracketRequest(string(payload), true)
+		if err != nil {
+			cw.WriteError(err, echoTag)
+			continue
 		}
 
-		writer, err := websocket.NextWriter(ws.TextMessage)
+		loginsession, err := sessionFromToken(token)
 		if err != nil {
-			log.Printf("Could not echo tag to client: %v", err)
+			cw.WriteError(err, echoTag)
+			continue
 		}
 
-		if cw.CurrWriter != nil {
-			_, err = writer.Write([]byte(echoTag))
-			if err != nil {
-				log.Printf("Could not echo tag to client: %v", err)
+		var viewable []uuid.UUID = uuids[:0]
+		var ctx = r.Context()
+		var cancelfunc context.CancelFunc
+		if bracketTimeout >= 0 {
+			ctx, cancelfunc = context.WithTimeout(ctx, bracketTimeout)
+		} else {
+			ctx, cancelfunc = context.WithCancel(ctx)
+		}
+		for _, uuid := range uuids {
+			/* A stream whose permissions cannot be checked has no bracket. */
+			if permitted, _ := hasPermission(ctx, loginsession, uuid); permitted {
+				viewable = append(viewable, uuid)
 			}
-			writer.Close()
 		}
-
-		cw.Writing.Unlock()
+		br.MakeBracketRequest(ctx, viewable, &cw)
+		cancelfunc()
+		finishWebSocketResponse(&cw, echoTag)
 	}
 }
 
 func bracketHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("You must send a POST request to get data."))
+	if onlyallowpost(w, r) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQSIZE)
-	payload, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+	payload, ok := readfullbody(w, r)
+	if !ok {
 		return
 	}
 
 	wrapper := RespWrapper{w}
 
-	uuids, token, _, success := parseBracketRequest(string(payload), wrapper, false)
+	uuids, token, _, err := parseBracketRequest(string(payload), false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-	if success {
-		var loginsession *LoginSession
-		if token != "" {
-			loginsession = validateToken(token)
-			if loginsession == nil {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(ERROR_INVALID_TOKEN))
-				return
-			}
-		}
-		var ctx = r.Context()
-		var cancelfunc context.CancelFunc
-		if bracketTimeout >= 0 {
-			ctx, cancelfunc = context.WithTimeout(ctx, bracketTimeout)
-		} else {
-			ctx, cancelfunc = context.WithCancel(ctx)
-		}
+	loginsession, err := sessionFromToken(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var ctx = r.Context()
+	var cancelfunc context.CancelFunc
+	if bracketTimeout >= 0 {
+		ctx, cancelfunc = context.WithTimeout(ctx, bracketTimeout)
+	} else {
+		ctx, cancelfunc = context.WithCancel(ctx)
+	}
 
-		filtereduuids := uuids[:0]
-		for _, uuid := range uuids {
-			if hasPermission(ctx, loginsession, uuid) {
-				filtereduuids = append(filtereduuids, uuid)
-			}
+	filtereduuids := uuids[:0]
+	for _, uuid := range uuids {
+		/* A stream whose permissions cannot be checked has no bracket. */
+		if permitted, _ := hasPermission(ctx, loginsession, uuid); permitted {
+			filtereduuids = append(filtereduuids, uuid)
 		}
-		br.MakeBracketRequest(ctx, filtereduuids, wrapper)
-		cancelfunc()
 	}
+	br.MakeBracketRequest(ctx, filtereduuids, wrapper)
+	cancelfunc()
+}
+
+/* A changes request has the form "uuid,fromversion,toversion,resolution,token".
+   A toversion of 0 refers to the latest version of the stream. */
+func parseChangesRequest(request string) (uuidBytes uuid.UUID, fromVersion uint64, toVersion uint64, resolution uint8, token string, err error) {
+	var args []string = strings.Split(request, ",")
+
+	if len(args) != 5 {
+		err = errBadRequest("Five arguments are required; got %v", len(args))
+		return
+	}
+
+	uuidBytes = uuid.Parse(args[0])
+	if uuidBytes == nil {
+		err = errBadRequest("Invalid UUID: got %v", args[0])
+		return
+	}
+
+	var resolutionTemp uint64
+	var perr error
+
+	fromVersion, perr = strconv.ParseUint(args[1], 10, 64)
+	if perr != nil {
+		err = errBadRequest("Could not interpret %v as a version number: %v", args[1], perr)
+		return
+	}
+
+	toVersion, perr = strconv.ParseUint(args[2], 10, 64)
+	if perr != nil {
+		err = errBadRequest("Could not interpret %v as a version number: %v", args[2], perr)
+		return
+	}
+
+	resolutionTemp, perr = strconv.ParseUint(args[3], 10, 8)
+	if perr != nil || resolutionTemp > 62 {
+		err = errBadRequest("Invalid resolution %v", args[3])
+		return
+	}
+	resolution = uint8(resolutionTemp)
+
+	token = args[4]
+
+	return
+}
+
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if onlyallowpost(w, r) {
+		return
+	}
+
+	payload, ok := readfullbody(w, r)
+	if !ok {
+		return
+	}
+
+	uuidBytes, fromVersion, toVersion, resolution, token, err := parseChangesRequest(string(payload))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	loginsession, err := sessionFromToken(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var ctx = r.Context()
+	var cancelfunc context.CancelFunc
+	if dataTimeout >= 0 {
+		ctx, cancelfunc = context.WithTimeout(ctx, dataTimeout)
+	} else {
+		ctx, cancelfunc = context.WithCancel(ctx)
+	}
+	defer cancelfunc()
+
+	if err = checkPermission(ctx, loginsession, uuidBytes); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var resp bytes.Buffer
+	err = btrdbError(ctx, dr.MakeChangesRequest(ctx, uuidBytes, fromVersion, toVersion, resolution, RespWrapper{&resp}))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp.Bytes())
 }
 
 func onlyallowpost(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("You must send a POST request to get data."))
+		writeMethodNotAllowed(w, "POST", "You must send a POST request to get data.")
 		return true
 	}
 	return false
@@ -881,7 +1223,7 @@ func readfullbody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
 	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQSIZE)
 	request, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		writeError(w, payloadError(err))
 		return nil, false
 	}
 	return request, true
@@ -895,13 +1237,10 @@ func treetopHandler(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
-	var ls *LoginSession
-	if len(request) != 0 {
-		ls = validateToken(string(request))
-		if ls == nil {
-			w.Write([]byte(ERROR_INVALID_TOKEN))
-			return
-		}
+	ls, err := sessionFromToken(string(request))
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 	var ctx = r.Context()
 	var cancelfunc context.CancelFunc
@@ -913,13 +1252,14 @@ func treetopHandler(w http.ResponseWriter, r *http.Request) {
 	toplevel, err := treetopPaths(ctx, etcdConn, btrdbConn, ls)
 	cancelfunc()
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
+		writeError(w, err)
 		return
 	}
+	setIndexAgeHeader(w)
 	enc := json.NewEncoder(w)
 	err = enc.Encode(toplevel)
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
+		log.Printf("Could not write response: %v", err)
 	}
 }
 
@@ -934,19 +1274,16 @@ func mdDispatch(w http.ResponseWriter, r *http.Request, dispatch func(context.Co
 
 	semicolonindex := bytes.IndexByte(request, ';')
 	if semicolonindex == -1 {
-		w.Write([]byte("Bad request."))
+		writeError(w, errBadRequest("Request must contain a token, followed by a semicolon"))
 		return
 	}
 	tokenencoded := request[:semicolonindex]
 	request = request[semicolonindex+1:]
 
-	var ls *LoginSession
-	if len(tokenencoded) != 0 {
-		ls = validateToken(string(tokenencoded))
-		if ls == nil {
-			w.Write([]byte(ERROR_INVALID_TOKEN))
-			return
-		}
+	ls, err := sessionFromToken(string(tokenencoded))
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 	var ctx = r.Context()
 	var cancelfunc context.CancelFunc
@@ -956,30 +1293,71 @@ func mdDispatch(w http.ResponseWriter, r *http.Request, dispatch func(context.Co
 		ctx, cancelfunc = context.WithCancel(ctx)
 	}
 	toplevel, err := dispatch(ctx, etcdConn, btrdbConn, ls, string(request))
+	err = btrdbError(ctx, err)
 	cancelfunc()
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
+		writeError(w, err)
 		return
 	}
+	setIndexAgeHeader(w)
 	w.Write(toplevel)
 }
 
 func treebranchHandler(w http.ResponseWriter, r *http.Request) {
 	mdDispatch(w, r, func(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, toplevel string) ([]byte, error) {
+		req, paginated, err := parseTreeRequest(toplevel)
+		if err != nil {
+			return nil, err
+		}
+		if paginated && req.Children {
+			page, err := treeChildren(ctx, ec, bc, ls, req)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(page)
+		} else if paginated {
+			toplevel = req.Path
+		}
+
 		levels, err := treebranchPaths(ctx, ec, bc, ls, toplevel)
 		if err != nil {
 			return nil, err
 		}
+		if paginated {
+			page, err := paginatePaths(levels, req)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(page)
+		}
 		return json.Marshal(levels)
 	})
 }
 
 func treeleafHandler(w http.ResponseWriter, r *http.Request) {
 	mdDispatch(w, r, func(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, branch string) ([]byte, error) {
+		req, paginated, err := parseTreeRequest(branch)
+		if err != nil {
+			return nil, err
+		}
+		if paginated {
+			if req.Children {
+				return nil, errBadRequest("Children may only be requested from /treebranch")
+			}
+			branch = req.Path
+		}
+
 		levels, err := treeleafPaths(ctx, ec, bc, ls, branch)
 		if err != nil {
 			return nil, err
 		}
+		if paginated {
+			page, err := paginatePaths(levels, req)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(page)
+		}
 		return json.Marshal(levels)
 	})
 }
@@ -1014,9 +1392,7 @@ const PERMALINK_BAD_ID = "not found"
 
 func permalinkHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" && r.Method != "POST" {
-		w.Header().Set("Allow", "GET POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte(PERMALINK_HELP))
+		writeMethodNotAllowed(w, "GET POST", PERMALINK_HELP)
 		return
 	}
 
@@ -1027,16 +1403,16 @@ func permalinkHandler(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		var id64str string = r.Form.Get("id")
 		if id64str == "" {
-			w.Write([]byte(PERMALINK_HELP))
+			writeError(w, errBadRequest("%s", PERMALINK_HELP))
 			return
 		}
 
 		pdata, err := permalink.RetrievePermalinkData(ctx, etcdConn, id64str)
 		if err != nil {
-			w.Write([]byte("Server error"))
+			writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not retrieve permalink: %v", err))
 			return
 		} else if pdata == nil {
-			w.Write([]byte(PERMALINK_BAD_ID))
+			writeError(w, newPlotterError(http.StatusNotFound, ERRCODE_NOT_FOUND, "%s", PERMALINK_BAD_ID))
 			return
 		}
 
@@ -1047,22 +1423,19 @@ func permalinkHandler(w http.ResponseWriter, r *http.Request) {
 
 		jsonLiteral, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+			writeError(w, payloadError(err))
 			return
 		}
 
 		err = json.Unmarshal(jsonLiteral, &jsonPermalink)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("Received invalid JSON: %v", err)))
+			writeError(w, errBadRequest("Received invalid JSON: %v", err))
 			return
 		}
 
 		err = validatePermalinkJSON(jsonPermalink)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
+			writeError(w, errBadRequest("%s", err.Error()))
 			return
 		}
 
@@ -1073,16 +1446,14 @@ func permalinkHandler(w http.ResponseWriter, r *http.Request) {
 		for trycount := 0; !success && trycount != permalinkMaxTries; trycount++ {
 			_, err = rand.Read(id)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(fmt.Sprintf("Could not generate new permalink ID: %v\n", err)))
+				writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not generate new permalink ID: %v", err))
 				return
 			}
 			base64.URLEncoding.Encode(id64buf, []byte(id))
 
 			success, err = permalink.InsertPermalinkData(ctx, etcdConn, string(id64buf), jsonLiteral)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(fmt.Sprintf("Could not insert permalink into database: %v", err)))
+				writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not insert permalink into database: %v", err))
 				return
 			}
 		}
@@ -1090,10 +1461,7 @@ func permalinkHandler(w http.ResponseWriter, r *http.Request) {
 		if success {
 			w.Write(id64buf)
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Server error"))
-
-			log.Printf("Could not find a unique permalink ID in %d tries!", permalinkMaxTries)
+			writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not find a unique permalink ID in %d tries", permalinkMaxTries))
 		}
 	}
 }
@@ -1103,6 +1471,7 @@ type RawCSVRequest struct {
 	StartTime  int64
 	EndTime    int64
 	UUIDs      []string `json:"UUIDS"`
+	Versions   []uint64
 	Labels     []string
 	QueryType  string
 	WindowText string
@@ -1110,39 +1479,67 @@ type RawCSVRequest struct {
 	UnitofTime string
 	Token      string `json:"_token,omitempty"`
 	PointWidth uint8
+	Format     string
+
+	NumberFormat string
+	Precision    *int
+
+	Timezone   string
+	DST        *bool
+	TimeFormat string
+
+	ResampleInterval uint64
+	Fill             string
+
+	Layout string
+
+	/* Instead of UUIDs, the streams may be given as a collection prefix and
+	   filters on tags and annotations, as for LookupStreams. */
+	Collection  string
+	Tags        map[string]*string
+	Annotations map[string]*string
+
+	/* Derived streams, written after the other streams. */
+	Derived []DerivedSpec
 }
 
-func csvHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		fmt.Fprint(w, "To get a CSV file, send the required data as a JSON document via a POST request.")
-		return
+/* Returns the timezone used to display times on the plot, given the "tz" and
+   "dst" settings of the plotter. The plot uses a fixed offset: the daylight
+   offset of the timezone if DST is true, or its standard offset otherwise. */
+func plotTimezone(name string, dst bool) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	janName, janOffset := time.Date(2014, time.January, 1, 0, 0, 0, 0, loc).Zone()
+	junName, junOffset := time.Date(2014, time.June, 1, 0, 0, 0, 0, loc).Zone()
+	if (junOffset > janOffset) == dst {
+		return time.FixedZone(junName, junOffset), nil
 	}
+	return time.FixedZone(janName, janOffset), nil
+}
 
+/* Parses a request for a CSV file (or another export format), checking that
+   the user has permission to read each stream. Returns the query and the
+   export format. */
+func parseCSVRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) (*csvquery.CSVQuery, string, error) {
 	var err error
 
 	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQSIZE)
 	_, err = io.ReadFull(r.Body, make([]byte, 5)) // Remove the "json="
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Bad request")
-		return
+		return nil, "", errBadRequest("Bad request")
 	}
 
 	var jsonCSVReq RawCSVRequest
 	var jsonCSVReqDecoder *json.Decoder = json.NewDecoder(r.Body)
 	err = jsonCSVReqDecoder.Decode(&jsonCSVReq)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Malformed request")
-		return
+		return nil, "", errBadRequest("Malformed request: %v", err)
 	}
 
 	if jsonCSVReq.PointWidth > 62 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Invalid point width: %d", jsonCSVReq.PointWidth)
-		return
+		return nil, "", errBadRequest("Invalid point width: %d", jsonCSVReq.PointWidth)
 	}
 
 	cq := &csvquery.CSVQuery{
@@ -1153,6 +1550,17 @@ func csvHandler(w http.ResponseWriter, r *http.Request) {
 		Labels:    jsonCSVReq.Labels,
 	}
 
+	/* If versions are given, then every stream must have one (0 meaning the
+	   latest version); the versions actually queried are reported in the CSV
+	   header. */
+	if jsonCSVReq.Versions != nil {
+		if len(jsonCSVReq.Versions) != len(jsonCSVReq.UUIDs) {
+			return nil, "", errBadRequest("Got %d streams but %d versions", len(jsonCSVReq.UUIDs), len(jsonCSVReq.Versions))
+		}
+		cq.Versions = jsonCSVReq.Versions
+		cq.IncludeVersions = true
+	}
+
 	switch jsonCSVReq.UnitofTime {
 	case "s":
 		cq.StartTime *= 1000000000
@@ -1167,20 +1575,12 @@ func csvHandler(w http.ResponseWriter, r *http.Request) {
 		cq.EndTime *= 1000
 	case "ns":
 	default:
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("Invalid unit of time: must be 'ns', 'ms', 'us' or 's' (got '%s')", jsonCSVReq.UnitofTime)))
-		return
+		return nil, "", errBadRequest("Invalid unit of time: must be 'ns', 'ms', 'us' or 's' (got '%s')", jsonCSVReq.UnitofTime)
 	}
 
-	var loginsession *LoginSession
-	if jsonCSVReq.Token != "" {
-		loginsession = validateToken(jsonCSVReq.Token)
-		if loginsession == nil {
-			w.WriteHeader(http.StatusBadRequest)
-			// Don't use ERROR_INVALID_TOKEN since this opens on a new page, not in the plotting application
-			w.Write([]byte("Session expired"))
-			return
-		}
+	loginsession, err := sessionFromToken(jsonCSVReq.Token)
+	if err != nil {
+		return nil, "", err
 	}
 
 	switch jsonCSVReq.QueryType {
@@ -1190,9 +1590,7 @@ func csvHandler(w http.ResponseWriter, r *http.Request) {
 		cq.QueryType = csvquery.WindowsQuery
 		cq.WindowSize, err = strconv.ParseUint(jsonCSVReq.WindowText, 0, 64)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Window size is not a valid number: %s", err.Error())
-			return
+			return nil, "", errBadRequest("Window size is not a valid number: %s", err.Error())
 		}
 		switch jsonCSVReq.WindowUnit {
 		case "years":
@@ -1221,23 +1619,106 @@ func csvHandler(w http.ResponseWriter, r *http.Request) {
 			fallthrough
 		case "nanoseconds":
 		default:
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Window size unit is invalid: %s", jsonCSVReq.WindowUnit)
-			return
+			return nil, "", errBadRequest("Window size unit is invalid: %s", jsonCSVReq.WindowUnit)
 		}
 	case "raw":
 		cq.QueryType = csvquery.RawQuery
 	default:
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Unknown query type %s", jsonCSVReq.QueryType)
-		return
+		return nil, "", errBadRequest("Unknown query type %s", jsonCSVReq.QueryType)
+	}
+
+	switch jsonCSVReq.NumberFormat {
+	case "", "shortest":
+		cq.NumberFormat = csvquery.ShortestFormat
+	case "scientific":
+		cq.NumberFormat = csvquery.ScientificFormat
+		cq.Precision = -1
+	case "fixed":
+		cq.NumberFormat = csvquery.FixedFormat
+		cq.Precision = 6
+	default:
+		return nil, "", errBadRequest("Unknown number format %s: must be 'shortest', 'scientific' or 'fixed'", jsonCSVReq.NumberFormat)
+	}
+	if jsonCSVReq.Precision != nil {
+		if *jsonCSVReq.Precision < 0 || *jsonCSVReq.Precision > 100 {
+			return nil, "", errBadRequest("Invalid precision %d", *jsonCSVReq.Precision)
+		}
+		cq.Precision = *jsonCSVReq.Precision
+	}
+
+	/* Resampling is given in nanoseconds, regardless of UnitofTime. */
+	if jsonCSVReq.ResampleInterval != 0 {
+		if cq.QueryType != csvquery.RawQuery {
+			return nil, "", errBadRequest("Only raw queries can be resampled")
+		}
+		if jsonCSVReq.ResampleInterval > math.MaxInt64 {
+			return nil, "", errBadRequest("Invalid resample interval %d", jsonCSVReq.ResampleInterval)
+		}
+		cq.ResampleInterval = jsonCSVReq.ResampleInterval
+	}
+	switch jsonCSVReq.Fill {
+	case "", "empty":
+		cq.Fill = csvquery.EmptyFill
+	case "previous":
+		cq.Fill = csvquery.PreviousFill
+	case "linear":
+		cq.Fill = csvquery.LinearFill
+	case "nan":
+		cq.Fill = csvquery.NaNFill
+	default:
+		return nil, "", errBadRequest("Unknown fill policy %s: must be 'empty', 'previous', 'linear' or 'nan'", jsonCSVReq.Fill)
+	}
+
+	switch jsonCSVReq.TimeFormat {
+	case "", "default":
+		cq.TimeFormat = csvquery.DefaultTimeFormat
+	case "rfc3339":
+		cq.TimeFormat = csvquery.RFC3339TimeFormat
+	case "iso":
+		cq.TimeFormat = csvquery.ISOTimeFormat
+	case "excel":
+		cq.TimeFormat = csvquery.ExcelTimeFormat
+	default:
+		return nil, "", errBadRequest("Unknown time format %s: must be 'default', 'rfc3339', 'iso' or 'excel'", jsonCSVReq.TimeFormat)
+	}
+	if jsonCSVReq.Timezone != "" {
+		if jsonCSVReq.DST != nil {
+			cq.Location, err = plotTimezone(jsonCSVReq.Timezone, *jsonCSVReq.DST)
+		} else {
+			cq.Location, err = time.LoadLocation(jsonCSVReq.Timezone)
+		}
+		if err != nil {
+			return nil, "", errBadRequest("Unknown timezone %s", jsonCSVReq.Timezone)
+		}
+	}
+
+	switch jsonCSVReq.Format {
+	case "":
+		jsonCSVReq.Format = "csv"
+	case "csv", "parquet", "arrow":
+	default:
+		return nil, "", errBadRequest("Unknown export format %s: must be 'csv', 'parquet' or 'arrow'", jsonCSVReq.Format)
+	}
+
+	switch jsonCSVReq.Layout {
+	case "", "wide":
+		cq.Layout = csvquery.WideLayout
+	case "long":
+		if jsonCSVReq.Format != "csv" {
+			return nil, "", errBadRequest("The long layout is only supported for CSV files")
+		}
+		cq.Layout = csvquery.LongLayout
+	default:
+		return nil, "", errBadRequest("Unknown layout %s: must be 'wide' or 'long'", jsonCSVReq.Layout)
 	}
 
 	/* Check the number of points per stream to see if this request is reasonable. */
 	if csvMaxPoints != 0 {
 		var deltaT = uint64(cq.EndTime - cq.StartTime)
 		var windowSize = cq.WindowSize
-		if windowSize == 0 {
+		if cq.ResampleInterval != 0 {
+			windowSize = cq.ResampleInterval
+		} else if windowSize == 0 {
 			windowSize = uint64(1) << cq.Depth
 		}
 		var pps = deltaT / windowSize
@@ -1245,69 +1726,153 @@ func csvHandler(w http.ResponseWriter, r *http.Request) {
 			pps++
 		}
 		if pps > csvMaxPoints {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("CSV file too big: estimated %d points", pps)))
-			return
+			return nil, "", newPlotterError(http.StatusRequestEntityTooLarge, ERRCODE_TOO_LARGE, "CSV file too big: estimated %d points", pps)
 		}
 	}
 
-	var ctx = r.Context()
-	if csvTimeout >= 0 {
-		var cancelfunc context.CancelFunc
-		ctx, cancelfunc = context.WithTimeout(ctx, csvTimeout)
-		defer cancelfunc()
+	if jsonCSVReq.Collection != "" || jsonCSVReq.Tags != nil || jsonCSVReq.Annotations != nil {
+		if len(jsonCSVReq.UUIDs) != 0 || jsonCSVReq.Labels != nil {
+			return nil, "", errBadRequest("Streams must be given either as UUIDs or as a collection, tag, and annotation filter, not both")
+		}
+		if jsonCSVReq.Versions != nil {
+			return nil, "", errBadRequest("Versions cannot be given for streams matched by a filter")
+		}
+		streams, paths, err := findStreams(ctx, btrdbConn, loginsession, jsonCSVReq.Collection, jsonCSVReq.Tags, jsonCSVReq.Annotations)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(streams) == 0 {
+			return nil, "", newPlotterError(http.StatusNotFound, ERRCODE_NOT_FOUND, "No streams match the filter")
+		}
+		cq.Streams = streams
+		cq.Labels = paths
 	}
 
 	for _, uuidstr := range jsonCSVReq.UUIDs {
 		uuidobj := uuid.Parse(uuidstr)
 		if uuidobj == nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, "Malformed UUID")
-			return
+			return nil, "", errBadRequest("Malformed UUID %s", uuidstr)
 		}
 
-		if !hasPermission(ctx, loginsession, uuidobj) {
-			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprint(w, "Insufficient permissions")
-			return
+		if err := checkPermission(ctx, loginsession, uuidobj); err != nil {
+			return nil, "", err
 		}
 
 		s := btrdbConn.StreamFromUUID(uuidobj)
-		ex, err2 := s.Exists(ctx)
-		if err2 != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "%s", err2.Error())
-			return
+		ex, err := s.Exists(ctx)
+		if err != nil {
+			return nil, "", err
 		}
 		if !ex {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, "Stream does not exist")
-			return
+			return nil, "", errNoSuchStream(uuidobj)
 		}
 
 		cq.Streams = append(cq.Streams, s)
 	}
 
-	w.Header().Set("Content-Disposition", "attachment; filename=data.csv")
-	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	cq.Transforms = make([]*transform.Transform, len(cq.Streams))
+	for i, s := range cq.Streams {
+		cq.Transforms[i], err = streamTransform(ctx, s.UUID())
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	for i := range jsonCSVReq.Derived {
+		var spec = &jsonCSVReq.Derived[i]
+		d, err := parseDerivedSpec(spec)
+		if err != nil {
+			return nil, "", err
+		}
+		if err = d.checkPermission(ctx, loginsession); err != nil {
+			return nil, "", err
+		}
+		if err = d.prepare(ctx); err != nil {
+			return nil, "", err
+		}
+		cq.Derived = append(cq.Derived, d.Stream)
+		if spec.Label != "" {
+			cq.Labels = append(cq.Labels, spec.Label)
+		} else {
+			cq.Labels = append(cq.Labels, spec.Expression)
+		}
+	}
+
+	return cq, jsonCSVReq.Format, nil
+}
+
+/* Returns the file extension and MIME type for an export format. */
+func exportFileType(format string) (string, string) {
+	switch format {
+	case "parquet":
+		return "parquet", "application/vnd.apache.parquet"
+	case "arrow":
+		return "arrow", "application/vnd.apache.arrow.file"
+	default:
+		return "csv", "text/csv; charset=utf-8"
+	}
+}
+
+/* Performs an export query, writing the file in the specified format to W. */
+func runExport(ctx context.Context, cq *csvquery.CSVQuery, format string, w io.Writer) error {
+	switch format {
+	case "parquet":
+		return csvquery.MakeParquetQuery(ctx, btrdbConn, cq, w)
+	case "arrow":
+		return csvquery.MakeArrowQuery(ctx, btrdbConn, cq, w)
+	}
 
 	cw := csv.NewWriter(w)
 	cw.UseCRLF = true
+	err := csvquery.MakeCSVQuery(ctx, btrdbConn, cq, cw)
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
 
-	err = csvquery.MakeCSVQuery(ctx, btrdbConn, cq, cw)
+func csvHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w, "POST", "To get a CSV file, send the required data as a JSON document via a POST request.")
+		return
+	}
+
+	var ctx = r.Context()
+	if csvTimeout >= 0 {
+		var cancelfunc context.CancelFunc
+		ctx, cancelfunc = context.WithTimeout(ctx, csvTimeout)
+		defer cancelfunc()
+	}
+
+	cq, format, err := parseCSVRequest(ctx, w, r)
 	if err != nil {
-		goto printerror
-	} else {
-		cw.Flush()
-		if err = cw.Error(); err != nil {
-			goto printerror
-		}
+		writeError(w, err)
+		return
 	}
 
-	return
+	ext, contentType := exportFileType(format)
+	w.Header().Set("Content-Disposition", "attachment; filename=data."+ext)
+	w.Header().Set("Content-Type", contentType)
+	if format == "csv" {
+		w.Header().Set("Transfer-Encoding", "chunked")
+	}
+
+	err = runExport(ctx, cq, format, w)
+	if err == nil {
+		return
+	}
+
+	/* The binary formats can't carry an error message, so if the query fails
+	   partway through, the file is simply truncated. */
+	if format != "csv" {
+		log.Printf("Could not complete %s query: %v", format, err)
+		return
+	}
 
-printerror:
+	/* The CSV file has already been partially sent, so it is too late to set
+	   the status. Append the error to the body so that it is not silently
+	   truncated. */
 	msg := fmt.Sprintf("Could not complete CSV query: %s", err.Error())
 	w.Write([]byte(msg))
 	log.Println(msg)
@@ -1315,9 +1880,7 @@ printerror:
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("To log in, make a POST request with JSON containing a username and password."))
+		writeMethodNotAllowed(w, "POST", "To log in, make a POST request with JSON containing a username and password.")
 		return
 	}
 
@@ -1334,47 +1897,45 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = loginDecoder.Decode(&jsonLogin)
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Error: received invalid JSON: %v", err)))
+		writeError(w, errBadRequest("Received invalid JSON: %v", err))
 		return
 	}
 
 	usernameint, ok = jsonLogin["username"]
 	if !ok {
-		w.Write([]byte(fmt.Sprintf("Error: JSON must contain field 'username'")))
+		writeError(w, errBadRequest("JSON must contain field 'username'"))
 		return
 	}
 
 	passwordint, ok = jsonLogin["password"]
 	if !ok {
-		w.Write([]byte(fmt.Sprintf("Error: JSON must contain field 'password'")))
+		writeError(w, errBadRequest("JSON must contain field 'password'"))
 		return
 	}
 
 	username, ok = usernameint.(string)
 	if !ok {
-		w.Write([]byte(fmt.Sprintf("Error: field 'username' must be a string")))
+		writeError(w, errBadRequest("Field 'username' must be a string"))
 		return
 	}
 
 	password, ok = passwordint.(string)
 	if !ok {
-		w.Write([]byte(fmt.Sprintf("Error: field 'password' must be a string")))
+		writeError(w, errBadRequest("Field 'password' must be a string"))
 		return
 	}
 
 	tokenarr, err := userlogin(context.TODO(), etcdConn, username, []byte(password))
 	if err != nil {
-		fmt.Printf("Could not verify login: %v\n", err)
-		// respond with a single space to indicate that there was a server error
-		// a space is not a valid base64 character, so it's not ambiguous
-		w.Write([]byte(" "))
+		writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not verify login: %v", err))
 	} else if tokenarr != nil {
 		// login was successful, so respond with the token
 		token64buf := make([]byte, base64.StdEncoding.EncodedLen(len(tokenarr)))
 		base64.StdEncoding.Encode(token64buf, tokenarr)
 		w.Write(token64buf)
+	} else {
+		writeError(w, newPlotterError(http.StatusUnauthorized, ERRCODE_INVALID_CREDENTIALS, "Invalid username or password"))
 	}
-	// else: invalid credentials, so respond with nothing
 }
 
 func parseToken(tokenencoded []byte) []byte {
@@ -1389,16 +1950,14 @@ func parseToken(tokenencoded []byte) []byte {
 
 func logoffHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("To log off, make a POST request with the session token."))
+		writeMethodNotAllowed(w, "POST", "To log off, make a POST request with the session token.")
 		return
 	}
 
 	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQSIZE)
 	tokenencoded, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		writeError(w, payloadError(err))
 		return
 	}
 	tokenslice := parseToken(tokenencoded)
@@ -1406,19 +1965,17 @@ func logoffHandler(w http.ResponseWriter, r *http.Request) {
 	if tokenslice != nil && userlogoff(tokenslice) {
 		w.Write([]byte("Logoff successful."))
 	} else {
-		w.Write([]byte("Invalid session token."))
+		writeError(w, errInvalidToken())
 	}
 }
 
 func changepwHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("To change password, make a POST request with the appropriate JSON document."))
+		writeMethodNotAllowed(w, "POST", "To change password, make a POST request with the appropriate JSON document.")
 		return
 	}
 
-	w.Write([]byte("Error: Password changes not supported"))
+	writeError(w, newPlotterError(http.StatusNotImplemented, ERRCODE_NOT_IMPLEMENTED, "Password changes not supported"))
 	return
 
 	//
@@ -1490,16 +2047,14 @@ func changepwHandler(w http.ResponseWriter, r *http.Request) {
 
 func checktokenHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		w.Header().Set("Allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("To check a token, make a POST request with the token in the request body."))
+		writeMethodNotAllowed(w, "POST", "To check a token, make a POST request with the token in the request body.")
 		return
 	}
 
 	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQSIZE)
 	tokenencoded, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("Could not read received POST payload: %v", err)))
+		writeError(w, payloadError(err))
 		return
 	}
 	tokenslice := parseToken(tokenencoded)
@@ -1507,6 +2062,6 @@ func checktokenHandler(w http.ResponseWriter, r *http.Request) {
 	if tokenslice != nil && getloginsession(tokenslice) != nil {
 		w.Write([]byte("ok"))
 	} else {
-		w.Write([]byte(ERROR_INVALID_TOKEN))
+		writeError(w, errInvalidToken())
 	}
 }
@@ -0,0 +1,319 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for computing summary statistics of streams
+   over a time range. A client POSTs "<uuid>[@<version>][;...],<start>,<end>,
+   <token>" to /statistics, with times in nanoseconds, and receives the
+   minimum, mean, maximum, and count of the points of each stream in
+   [start, end).
+
+   The statistics are exact. The range is covered with the coarsest aligned
+   windows that fit inside it, and the parts of the range at either end that
+   are too small for those windows are covered with finer windows, recursively,
+   down to windows of a single nanosecond. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	"github.com/BTrDB/mr-plotter/transform"
+
+	"github.com/pborman/uuid"
+)
+
+/* How much finer each level of windows is than the one before it. Each query
+   returns at most 2^STATISTICS_PW_STEP windows for each end of the range. */
+const STATISTICS_PW_STEP uint8 = 6
+
+/* The coarsest point width used to compute statistics. */
+const STATISTICS_MAX_PW uint8 = 62
+
+// StreamStatistics summarizes the points of a stream in a time range. Min,
+// Mean, and Max are omitted if there are no points.
+type StreamStatistics struct {
+	UUID    string
+	Version uint64
+	Count   uint64
+	Min     *float64 `json:",omitempty"`
+	Mean    *float64 `json:",omitempty"`
+	Max     *float64 `json:",omitempty"`
+}
+
+type statAccumulator struct {
+	min   float64
+	max   float64
+	sum   float64
+	count uint64
+}
+
+func (acc *statAccumulator) add(pt btrdb.StatPoint) {
+	if pt.Count == 0 {
+		return
+	}
+	if acc.count == 0 || pt.Min < acc.min {
+		acc.min = pt.Min
+	}
+	if acc.count == 0 || pt.Max > acc.max {
+		acc.max = pt.Max
+	}
+	acc.sum += pt.Mean * float64(pt.Count)
+	acc.count += pt.Count
+}
+
+/* Returns the statistics, with TF applied to them if it is not nil. */
+func (acc *statAccumulator) statistics(uu uuid.UUID, version uint64, tf *transform.Transform) *StreamStatistics {
+	var stats = &StreamStatistics{
+		UUID:    uu.String(),
+		Version: version,
+		Count:   acc.count,
+	}
+	if acc.count != 0 {
+		var pt = btrdb.StatPoint{Min: acc.min, Mean: acc.sum / float64(acc.count), Max: acc.max}
+		if tf != nil {
+			pt = tf.ApplyStatPoint(pt)
+		}
+		stats.Min = &pt.Min
+		stats.Mean = &pt.Mean
+		stats.Max = &pt.Max
+	}
+	return stats
+}
+
+/* Returns the first multiple of SIZE (a power of two) that is at least T, and
+   false if there is no such int64. */
+func alignUp(t int64, size int64) (int64, bool) {
+	var aligned = t &^ (size - 1)
+	if aligned == t {
+		return t, true
+	}
+	aligned += size
+	return aligned, aligned > t
+}
+
+/* Adds the points of STREAM in [START, END) to ACC, using aligned windows with
+   point width at most PW. VERSION must not be 0, so that every query sees the
+   same version of the stream. */
+func (dr *DataRequester) accumulateStatistics(ctx context.Context, stream *btrdb.Stream, version uint64, start int64, end int64, pw uint8, acc *statAccumulator) error {
+	for start < end {
+		var size = int64(1) << pw
+		alignedStart, ok := alignUp(start, size)
+		var alignedEnd = end &^ (size - 1)
+		if !ok || alignedStart >= alignedEnd {
+			/* No window of this size fits; try a finer one. Windows of a
+			   single nanosecond always fit. */
+			if pw < STATISTICS_PW_STEP {
+				pw = 0
+			} else {
+				pw -= STATISTICS_PW_STEP
+			}
+			continue
+		}
+
+		var points []btrdb.StatPoint
+		var err error
+		if dr.cache != nil {
+			points, _, err = dr.cachedWindows(ctx, stream, version, alignedStart, alignedEnd, 0, pw)
+		} else {
+			points, _, err = collectStatPoints(stream.AlignedWindows(ctx, alignedStart, alignedEnd, pw, version))
+		}
+		if err != nil {
+			return err
+		}
+		for _, pt := range points {
+			acc.add(pt)
+		}
+
+		if err = dr.accumulateStatistics(ctx, stream, version, start, alignedStart, pw, acc); err != nil {
+			return err
+		}
+		start = alignedEnd
+	}
+	return nil
+}
+
+/* Computes the statistics of each stream in [START, END), at the specified
+   versions (0 meaning the latest version), and writes them to the specified
+   Writer as a JSON array. */
+func (dr *DataRequester) MakeStatisticsRequest(ctx context.Context, uuids []uuid.UUID, versions []uint64, startTime int64, endTime int64, writ Writable) error {
+	atomic.AddUint64(&dr.totalWaiting, 1)
+	defer atomic.AddUint64(&dr.totalWaiting, 0xFFFFFFFFFFFFFFFF)
+
+	dr.pendingLock.Lock()
+	for dr.pending == dr.maxPending {
+		dr.pendingCondVar.Wait()
+	}
+	dr.pending += 1
+	dr.pendingLock.Unlock()
+
+	defer func() {
+		dr.pendingLock.Lock()
+		dr.pending -= 1
+		dr.pendingCondVar.Signal()
+		dr.pendingLock.Unlock()
+	}()
+
+	var results = make([]*StreamStatistics, len(uuids))
+	for i, uu := range uuids {
+		var stream = dr.btrdb.StreamFromUUID(uu)
+		exists, err := stream.Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errNoSuchStream(uu)
+		}
+
+		var version = versions[i]
+		if version == 0 {
+			version, err = stream.Version(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		tf, err := streamTransform(ctx, uu)
+		if err != nil {
+			return err
+		}
+
+		var acc statAccumulator
+		err = dr.accumulateStatistics(ctx, stream, version, startTime, endTime, STATISTICS_MAX_PW, &acc)
+		if err != nil {
+			return err
+		}
+		results[i] = acc.statistics(uu, version, tf)
+	}
+
+	encoded, err := json.Marshal(results)
+	if err != nil {
+		return newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not encode statistics: %v", err)
+	}
+	var w io.Writer = writ.GetWriter()
+	w.Write(encoded)
+	return nil
+}
+
+func parseStatisticsRequest(request string) (uuids []uuid.UUID, versions []uint64, startTime int64, endTime int64, token string, err error) {
+	var args []string = strings.Split(request, ",")
+
+	if len(args) != 4 {
+		err = errBadRequest("Four arguments are required; got %v", len(args))
+		return
+	}
+
+	var uuidstrs []string = strings.Split(args[0], BATCH_SEPARATOR)
+	uuids = make([]uuid.UUID, len(uuidstrs))
+	versions = make([]uint64, len(uuidstrs))
+	var perr error
+	for i, uuidstr := range uuidstrs {
+		if sep := strings.Index(uuidstr, VERSION_SEPARATOR); sep != -1 {
+			versions[i], perr = strconv.ParseUint(uuidstr[sep+1:], 10, 64)
+			if perr != nil {
+				err = errBadRequest("Could not interpret %v as a version number: %v", uuidstr[sep+1:], perr)
+				return
+			}
+			uuidstr = uuidstr[:sep]
+		}
+		uuids[i] = uuid.Parse(uuidstr)
+		if uuids[i] == nil {
+			err = errBadRequest("Invalid UUID: got %v", uuidstr)
+			return
+		}
+	}
+
+	startTime, perr = strconv.ParseInt(args[1], 10, 64)
+	if perr != nil {
+		err = errBadRequest("Could not interpret %v as an int64: %v", args[1], perr)
+		return
+	}
+
+	endTime, perr = strconv.ParseInt(args[2], 10, 64)
+	if perr != nil {
+		err = errBadRequest("Could not interpret %v as an int64: %v", args[2], perr)
+		return
+	}
+
+	if startTime > endTime || startTime < btrdb.MinimumTime || endTime > btrdb.MaximumTime {
+		err = errBadRequest("Invalid time range [%v, %v)", startTime, endTime)
+		return
+	}
+
+	token = args[3]
+
+	return
+}
+
+func statisticsHandler(w http.ResponseWriter, r *http.Request) {
+	if onlyallowpost(w, r) {
+		return
+	}
+
+	payload, ok := readfullbody(w, r)
+	if !ok {
+		return
+	}
+
+	uuids, versions, startTime, endTime, token, err := parseStatisticsRequest(string(payload))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	loginsession, err := sessionFromToken(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var ctx = r.Context()
+	var cancelfunc context.CancelFunc
+	if dataTimeout >= 0 {
+		ctx, cancelfunc = context.WithTimeout(ctx, dataTimeout)
+	} else {
+		ctx, cancelfunc = context.WithCancel(ctx)
+	}
+	defer cancelfunc()
+
+	for _, uu := range uuids {
+		if err := checkPermission(ctx, loginsession, uu); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	var resp bytes.Buffer
+	err = btrdbError(ctx, dr.MakeStatisticsRequest(ctx, uuids, versions, startTime, endTime, RespWrapper{&resp}))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(resp.Bytes())
+}
@@ -0,0 +1,472 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for live subscriptions to the tail of a stream.
+   A client opens a WebSocket to /subscribews and sends messages of the form
+   "subscribe,<uuid>,<pw>,<token>" and "unsubscribe,<uuid>,<pw>". For each
+   (stream, point width) pair that has at least one subscriber, a single
+   watcher polls BTrDB for a new version of the stream; when it sees one, it
+   finds the new right bracket and the aligned windows between the previous
+   bracket and the new one, and pushes them to every subscriber.
+
+   Updates are coalesced: if a client falls behind, the updates for a stream
+   that it has not yet received are merged, so it receives one message with
+   all of the new points and the latest bracket. The window containing the
+   previous bracket is sent again in each update, since new points may have
+   been added to it; clients should replace any point they already have at the
+   same time. Changes to the stream before the previous bracket are not pushed
+   (the /changes endpoint can be used to find those).
+
+   An error response to a subscription request has the "UUID" and
+   "PointWidth" fields of the subscription, in addition to the "error"
+   field. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	ws "github.com/gorilla/websocket"
+	uuid "github.com/pborman/uuid"
+)
+
+const MAX_SUBSCRIPTIONS_PER_CONN int = 256
+const DEFAULT_SUBSCRIPTION_POLL_INTERVAL time.Duration = time.Second
+
+/* The longest a watcher waits between polls while polling keeps failing. */
+const MAX_SUBSCRIPTION_BACKOFF time.Duration = 5 * time.Minute
+
+var subscriptionPollInterval time.Duration
+
+type watchKey struct {
+	uu uuid.Array
+	pw uint8
+}
+
+/* A pending update for a single subscription, which has not yet been sent to
+   the client. */
+type tailUpdate struct {
+	version uint64
+	bracket int64
+	points  []btrdb.StatPoint
+}
+
+/* Merges NEXT into UPD, where NEXT was produced after UPD. */
+func (upd *tailUpdate) merge(next *tailUpdate) {
+	upd.version = next.version
+	upd.bracket = next.bracket
+	if len(next.points) != 0 {
+		/* The first window of NEXT may overlap the last window of UPD. */
+		var firstTime = next.points[0].Time
+		var keep = len(upd.points)
+		for keep != 0 && upd.points[keep-1].Time >= firstTime {
+			keep--
+		}
+		upd.points = append(upd.points[:keep], next.points...)
+	}
+}
+
+type subscriber struct {
+	cw      *ConnWrapper
+	lock    sync.Mutex
+	pending map[watchKey]*tailUpdate
+	notify  chan struct{}
+}
+
+func newSubscriber(cw *ConnWrapper) *subscriber {
+	return &subscriber{
+		cw:      cw,
+		pending: make(map[watchKey]*tailUpdate),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+/* Queues an update for delivery, merging it with any undelivered update for
+   the same subscription. */
+func (sub *subscriber) push(key watchKey, upd *tailUpdate) {
+	sub.lock.Lock()
+	if prev, ok := sub.pending[key]; ok {
+		prev.merge(upd)
+	} else {
+		var copied = *upd
+		copied.points = append([]btrdb.StatPoint(nil), upd.points...)
+		sub.pending[key] = &copied
+	}
+	sub.lock.Unlock()
+
+	select {
+	case sub.notify <- struct{}{}:
+	default:
+	}
+}
+
+/* Sends queued updates to the client until CTX is cancelled or the
+   WebSocket fails. */
+func (sub *subscriber) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-sub.notify:
+		case <-ctx.Done():
+			return
+		}
+
+		sub.lock.Lock()
+		var pending = sub.pending
+		sub.pending = make(map[watchKey]*tailUpdate)
+		sub.lock.Unlock()
+
+		for key, upd := range pending {
+			var msg bytes.Buffer
+			bMillis, bNanos := splitTime(upd.bracket)
+			fmt.Fprintf(&msg, "{\"UUID\":\"%s\",\"PointWidth\":%d,\"Version\":%d,\"Bracket\":[%v,%v],\"Points\":", key.uu.String(), key.pw, upd.version, bMillis, bNanos)
+			writeTextPoints(&msg, upd.points)
+			msg.WriteString("}")
+
+			sub.cw.Writing.Lock()
+			err := sub.cw.Conn.WriteMessage(ws.TextMessage, msg.Bytes())
+			sub.cw.Writing.Unlock()
+			if err != nil {
+				log.Printf("Could not push update to client: %v", err)
+				return
+			}
+		}
+	}
+}
+
+/* Watches the tail of a single stream at a single point width, on behalf of
+   all of its subscribers. */
+type streamWatcher struct {
+	key         watchKey
+	subscribers map[*subscriber]struct{}
+	cancel      context.CancelFunc
+
+	/* The version and bracket most recently sent to subscribers, or nil if
+	   nothing has been sent yet. */
+	last *tailUpdate
+}
+
+var watchersLock sync.Mutex
+var watchers = make(map[watchKey]*streamWatcher)
+
+func subscribe(sub *subscriber, key watchKey) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+
+	watcher, ok := watchers[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		watcher = &streamWatcher{
+			key:         key,
+			subscribers: make(map[*subscriber]struct{}),
+			cancel:      cancel,
+		}
+		watchers[key] = watcher
+		go watcher.run(ctx)
+	}
+	watcher.subscribers[sub] = struct{}{}
+	if watcher.last != nil {
+		sub.push(key, watcher.last)
+	}
+}
+
+func unsubscribe(sub *subscriber, key watchKey) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+
+	watcher, ok := watchers[key]
+	if !ok {
+		return
+	}
+	delete(watcher.subscribers, sub)
+	if len(watcher.subscribers) == 0 {
+		watcher.cancel()
+		delete(watchers, key)
+	}
+}
+
+func (sw *streamWatcher) broadcast(upd *tailUpdate) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+
+	for sub := range sw.subscribers {
+		sub.push(sw.key, upd)
+	}
+	sw.last = &tailUpdate{
+		version: upd.version,
+		bracket: upd.bracket,
+		points:  []btrdb.StatPoint{},
+	}
+}
+
+func (sw *streamWatcher) run(ctx context.Context) {
+	var stream = btrdbConn.StreamFromUUID(sw.key.uu.UUID())
+	var version uint64
+	var bracket int64 = INVALID_TIME
+
+	/* After each consecutive failure, the time between polls is doubled, up
+	   to MAX_SUBSCRIPTION_BACKOFF, and failures are logged only when the
+	   count reaches a power of two. */
+	var failures uint
+	var delay = subscriptionPollInterval
+
+	for {
+		upd, err := sw.poll(ctx, stream, version, bracket)
+		if err != nil && ctx.Err() == nil {
+			failures++
+			if failures&(failures-1) == 0 {
+				log.Printf("Could not poll stream %s for subscribers (%d consecutive failures): %v", sw.key.uu.String(), failures, err)
+			}
+			if delay < MAX_SUBSCRIPTION_BACKOFF {
+				delay *= 2
+				if delay > MAX_SUBSCRIPTION_BACKOFF {
+					delay = MAX_SUBSCRIPTION_BACKOFF
+				}
+			}
+		} else {
+			failures = 0
+			delay = subscriptionPollInterval
+			if upd != nil {
+				version = upd.version
+				bracket = upd.bracket
+				/* Nothing is sent until the stream has a point. */
+				if bracket != INVALID_TIME {
+					sw.broadcast(upd)
+				}
+			}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/* Checks whether the stream has a version newer than VERSION, and if so,
+   returns the update to send to subscribers. BRACKET is the right bracket
+   that subscribers were last sent. The first update for a stream contains
+   only its bracket. If the stream has no points, the update has no bracket
+   (i.e., it is INVALID_TIME). */
+func (sw *streamWatcher) poll(ctx context.Context, stream *btrdb.Stream, version uint64, bracket int64) (*tailUpdate, error) {
+	var cancelfunc context.CancelFunc
+	if dataTimeout >= 0 {
+		ctx, cancelfunc = context.WithTimeout(ctx, dataTimeout)
+	} else {
+		ctx, cancelfunc = context.WithCancel(ctx)
+	}
+	defer cancelfunc()
+
+	latest, err := stream.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if latest == version {
+		return nil, nil
+	}
+
+	rawpoint, _, err := stream.Nearest(ctx, QUASAR_HIGH, latest, true)
+	if err != nil {
+		/* As in MakeBracketRequest, this means the stream has no points.
+		   Remember the version, so the stream is not queried again until
+		   it changes. */
+		return &tailUpdate{version: latest, bracket: INVALID_TIME, points: []btrdb.StatPoint{}}, nil
+	}
+
+	var upd = &tailUpdate{
+		version: latest,
+		bracket: rawpoint.Time,
+		points:  []btrdb.StatPoint{},
+	}
+	if bracket == INVALID_TIME || rawpoint.Time < bracket {
+		return upd, nil
+	}
+
+	var pw = sw.key.pw
+	var start = (bracket >> pw) << pw
+	var end = ((rawpoint.Time >> pw) + 1) << pw
+	upd.points, _, err = collectStatPoints(stream.AlignedWindows(ctx, start, end, pw, latest))
+	if err != nil {
+		return nil, err
+	}
+
+	/* The transform is looked up on every update, so that a change to it
+	   applies to the next update. */
+	tf, err := streamTransform(ctx, sw.key.uu.UUID())
+	if err != nil {
+		return nil, err
+	}
+	if tf != nil {
+		upd.points = tf.ApplyStatPoints(upd.points)
+	}
+	return upd, nil
+}
+
+/* A subscription request has the form "subscribe,<uuid>,<pw>,<token>" or
+   "unsubscribe,<uuid>,<pw>". */
+func parseSubscriptionRequest(request string) (subscribing bool, key watchKey, token string, err error) {
+	var args []string = strings.Split(request, ",")
+
+	switch {
+	case len(args) == 4 && args[0] == "subscribe":
+		subscribing = true
+		token = args[3]
+	case len(args) == 3 && args[0] == "unsubscribe":
+		subscribing = false
+	default:
+		err = errBadRequest("Request must be \"subscribe,<uuid>,<pw>,<token>\" or \"unsubscribe,<uuid>,<pw>\"")
+		return
+	}
+
+	var uu = uuid.Parse(args[1])
+	if uu == nil {
+		err = errBadRequest("Invalid UUID: got %v", args[1])
+		return
+	}
+
+	pw, perr := strconv.ParseUint(args[2], 10, 8)
+	if perr != nil || pw > 62 {
+		err = errBadRequest("Invalid point width %v", args[2])
+		return
+	}
+
+	key = watchKey{uu: uu.Array(), pw: uint8(pw)}
+	return
+}
+
+func subscribewsHandler(w http.ResponseWriter, r *http.Request) {
+	var websocket *ws.Conn
+	var upgradeerr error
+	websocket, upgradeerr = upgrader.Upgrade(w, r, nil)
+	if upgradeerr != nil {
+		return // The upgrader has already replied with an error
+	}
+
+	cw := &ConnWrapper{
+		Writing:     &sync.Mutex{},
+		Conn:        websocket,
+		MessageType: ws.TextMessage,
+	}
+
+	websocket.SetReadLimit(MAX_REQSIZE)
+
+	var sub = newSubscriber(cw)
+	var subscriptions = make(map[watchKey]struct{})
+
+	connctx, conncancel := context.WithCancel(r.Context())
+	go sub.deliver(connctx)
+	defer func() {
+		conncancel()
+		for key := range subscriptions {
+			unsubscribe(sub, key)
+		}
+	}()
+
+	for {
+		_, payload, err := websocket.ReadMessage()
+
+		if err != nil {
+			return // Most likely the connection was closed or the message was too big
+		}
+
+		subscribing, key, token, err := parseSubscriptionRequest(string(payload))
+		if err != nil {
+			writeSubscriptionError(cw, err, nil)
+			continue
+		}
+
+		if !subscribing {
+			if _, ok := subscriptions[key]; ok {
+				delete(subscriptions, key)
+				unsubscribe(sub, key)
+			}
+			continue
+		}
+
+		loginsession, err := sessionFromToken(token)
+		if err != nil {
+			writeSubscriptionError(cw, err, &key)
+			continue
+		}
+
+		var ctx = connctx
+		var cancelfunc context.CancelFunc
+		if dataTimeout >= 0 {
+			ctx, cancelfunc = context.WithTimeout(ctx, dataTimeout)
+		} else {
+			ctx, cancelfunc = context.WithCancel(ctx)
+		}
+		err = checkPermission(ctx, loginsession, key.uu.UUID())
+		cancelfunc()
+		if err != nil {
+			writeSubscriptionError(cw, err, &key)
+			continue
+		}
+
+		if _, ok := subscriptions[key]; ok {
+			continue
+		}
+		if len(subscriptions) == MAX_SUBSCRIPTIONS_PER_CONN {
+			writeSubscriptionError(cw, errBadRequest("At most %d subscriptions are allowed on a single connection", MAX_SUBSCRIPTIONS_PER_CONN), &key)
+			continue
+		}
+		subscriptions[key] = struct{}{}
+		subscribe(sub, key)
+	}
+}
+
+/* An error response on /subscribews. UUID and PointWidth identify the
+   subscription that failed, and are omitted if the request could not be
+   parsed. */
+type subscriptionError struct {
+	Error      *PlotterError `json:"error"`
+	UUID       string        `json:",omitempty"`
+	PointWidth *uint8        `json:",omitempty"`
+}
+
+func writeSubscriptionError(cw *ConnWrapper, err error, key *watchKey) {
+	var envelope = subscriptionError{Error: toPlotterError(err)}
+	if key != nil {
+		envelope.UUID = key.uu.String()
+		envelope.PointWidth = &key.pw
+	}
+	encoded, merr := json.Marshal(envelope)
+	if merr != nil {
+		log.Fatalf("Could not JSON-encode error response: %v", merr)
+	}
+
+	cw.Writing.Lock()
+	werr := cw.Conn.WriteMessage(ws.TextMessage, encoded)
+	cw.Writing.Unlock()
+	if werr != nil {
+		log.Printf("Could not write error to client: %v", werr)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2017 Sam Kumar <samkumar@berkeley.edu>
+ * Copyright (c) 2017 University of California, Berkeley
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *     * Neither the name of the University of California, Berkeley nor the
+ *       names of its contributors may be used to endorse or promote products
+ *       derived from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+ * WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNERS OR CONTRIBUTORS BE LIABLE FOR
+ * ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+ * LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ * ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ * (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package transform stores and applies per-stream transforms, which scale and
+// offset the values of a stream before they are displayed, for example to
+// convert them to a different unit.
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/pborman/uuid"
+	btrdb "gopkg.in/BTrDB/btrdb.v4"
+)
+
+const etcdpath string = "mrplotter/transforms/"
+
+var etcdprefix = ""
+
+func getTransformEtcdKey(uu uuid.UUID) string {
+	return fmt.Sprintf("%s%s%s", etcdprefix, etcdpath, uu.String())
+}
+
+// Sets the prefix added to keys in the etcd database.
+// The keys used are of the form <prefix>mrplotter/transforms/<uuid>.
+func SetEtcdKeyPrefix(prefix string) {
+	etcdprefix = prefix
+}
+
+// Transform maps each value x of a stream to x * Scale + Offset. Unit, if not
+// empty, is the unit of the transformed values.
+type Transform struct {
+	Scale  float64
+	Offset float64
+	Unit   string `json:",omitempty"`
+}
+
+// Apply returns the transformed value of x.
+func (t *Transform) Apply(x float64) float64 {
+	return x*t.Scale + t.Offset
+}
+
+// ApplyStatPoints returns a new slice containing the transformed points. The
+// minimum and maximum are swapped if Scale is negative.
+func (t *Transform) ApplyStatPoints(points []btrdb.StatPoint) []btrdb.StatPoint {
+	var transformed = make([]btrdb.StatPoint, len(points))
+	for i, pt := range points {
+		transformed[i] = t.ApplyStatPoint(pt)
+	}
+	return transformed
+}
+
+// ApplyStatPoint returns the transformed point.
+func (t *Transform) ApplyStatPoint(pt btrdb.StatPoint) btrdb.StatPoint {
+	pt.Min, pt.Mean, pt.Max = t.Apply(pt.Min), t.Apply(pt.Mean), t.Apply(pt.Max)
+	if t.Scale < 0 {
+		pt.Min, pt.Max = pt.Max, pt.Min
+	}
+	return pt
+}
+
+// ApplyRawPoints returns a new slice containing the transformed points.
+func (t *Transform) ApplyRawPoints(points []btrdb.RawPoint) []btrdb.RawPoint {
+	var transformed = make([]btrdb.RawPoint, len(points))
+	for i, pt := range points {
+		transformed[i] = btrdb.RawPoint{Time: pt.Time, Value: t.Apply(pt.Value)}
+	}
+	return transformed
+}
+
+/* Metric prefixes understood by Conversion, with the empty prefix first so
+   that a unit that looks like a prefix (e.g. "m") is read as a unit. */
+var metricPrefixes = []struct {
+	symbol string
+	factor float64
+}{
+	{"", 1},
+	{"T", 1e12},
+	{"G", 1e9},
+	{"M", 1e6},
+	{"k", 1e3},
+	{"c", 1e-2},
+	{"m", 1e-3},
+	{"u", 1e-6},
+	{"µ", 1e-6},
+	{"n", 1e-9},
+}
+
+// Conversion returns the scale that converts values in the unit from to the
+// unit to, if they differ only in their metric prefix (e.g. "V" and "kV").
+// Returns false if no such conversion is known.
+func Conversion(from string, to string) (float64, bool) {
+	if from == to {
+		return 1, from != ""
+	}
+	for _, fp := range metricPrefixes {
+		if !strings.HasPrefix(from, fp.symbol) || len(from) == len(fp.symbol) {
+			continue
+		}
+		for _, tp := range metricPrefixes {
+			if strings.HasPrefix(to, tp.symbol) && from[len(fp.symbol):] == to[len(tp.symbol):] {
+				return fp.factor / tp.factor, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Retrieves the transform for a stream. Returns nil if the stream has no
+// transform.
+func RetrieveTransform(ctx context.Context, etcdClient *etcd.Client, uu uuid.UUID) (*Transform, error) {
+	etcdKey := getTransformEtcdKey(uu)
+	resp, err := etcdClient.Get(ctx, etcdKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	var t Transform
+	if err = json.Unmarshal(resp.Kvs[0].Value, &t); err != nil {
+		return nil, fmt.Errorf("Malformed transform for stream %s: %v", uu.String(), err)
+	}
+	return &t, nil
+}
+
+// Sets the transform for a stream, replacing any existing transform.
+func UpsertTransform(ctx context.Context, etcdClient *etcd.Client, uu uuid.UUID, t *Transform) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	etcdKey := getTransformEtcdKey(uu)
+	_, err = etcdClient.Put(ctx, etcdKey, string(data))
+	return err
+}
+
+// Removes the transform for a stream. Returns true if it had a transform.
+func DeleteTransform(ctx context.Context, etcdClient *etcd.Client, uu uuid.UUID) (bool, error) {
+	etcdKey := getTransformEtcdKey(uu)
+	resp, err := etcdClient.Delete(ctx, etcdKey)
+	if err != nil {
+		return false, err
+	}
+	return resp.Deleted != 0, nil
+}
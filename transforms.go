@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for managing per-stream transforms (see the
+   transform package), which scale and offset the values of a stream wherever
+   it is queried, so that every user sees it in the same unit. A transform is
+   retrieved with a GET request to /transform with "uuid=<uuid>" in the URL,
+   and set or removed by POSTing a JSON document of the form
+   {"UUID": "<uuid>", "Scale": 0.001, "Offset": 0, "Unit": "kV",
+   "_token": "<token>"} or {"UUID": "<uuid>", "Delete": true, "_token": ...}.
+   If Scale is omitted, it is computed from the stream's unit annotation and
+   Unit, if they differ only in their metric prefix. Setting or removing a
+   transform requires the "plotter-write" capability in a group whose
+   prefixes include the stream's collection. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/BTrDB/mr-plotter/transform"
+
+	"github.com/pborman/uuid"
+)
+
+const TRANSFORM_HELP = "To retrieve the transform for a stream, send a GET request with \"uuid=<uuid>\" in the URL. To set or remove it, POST a JSON document with the fields UUID, Scale, Offset, Unit, Delete, and _token."
+const UNIT_ANNOTATION = "unit"
+
+// RawTransformRequest encapsulates a request to set or remove the transform
+// for a stream.
+type RawTransformRequest struct {
+	UUID   string
+	Scale  *float64
+	Offset float64
+	Unit   string
+	Delete bool
+	Token  string `json:"_token,omitempty"`
+}
+
+/* Returns the transform for the stream, or nil if it has none. */
+func streamTransform(ctx context.Context, uu uuid.UUID) (*transform.Transform, error) {
+	t, err := transform.RetrieveTransform(ctx, etcdConn, uu)
+	if err != nil {
+		return nil, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not retrieve transform: %v", err)
+	}
+	return t, nil
+}
+
+func transformHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		writeMethodNotAllowed(w, "GET POST", TRANSFORM_HELP)
+		return
+	}
+
+	ctx := r.Context()
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQSIZE)
+	if r.Method == "GET" {
+		r.ParseForm()
+		uu := uuid.Parse(r.Form.Get("uuid"))
+		if uu == nil {
+			writeError(w, errBadRequest("%s", TRANSFORM_HELP))
+			return
+		}
+		loginsession, err := sessionFromToken(r.Form.Get("token"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := checkPermission(ctx, loginsession, uu); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		t, err := streamTransform(ctx, uu)
+		if err != nil {
+			writeError(w, err)
+			return
+		} else if t == nil {
+			writeError(w, newPlotterError(http.StatusNotFound, ERRCODE_NOT_FOUND, "Stream %s has no transform", uu.String()))
+			return
+		}
+
+		encoded, err := json.Marshal(t)
+		if err != nil {
+			writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not encode transform: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(encoded)
+		return
+	}
+
+	jsonLiteral, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, payloadError(err))
+		return
+	}
+	var req RawTransformRequest
+	if err = json.Unmarshal(jsonLiteral, &req); err != nil {
+		writeError(w, errBadRequest("Received invalid JSON: %v", err))
+		return
+	}
+	uu := uuid.Parse(req.UUID)
+	if uu == nil {
+		writeError(w, errBadRequest("Invalid UUID: got %v", req.UUID))
+		return
+	}
+
+	/* A transform changes the stream for every user, so setting one requires
+	   permission to edit the stream's metadata. */
+	loginsession, err := sessionFromToken(req.Token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if loginsession == nil {
+		writeError(w, errInvalidToken())
+		return
+	}
+
+	s := btrdbConn.StreamFromUUID(uu)
+	ex, err := s.Exists(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !ex {
+		writeError(w, errNoSuchStream(uu))
+		return
+	}
+	collection, err := s.Collection(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkPermission(ctx, loginsession, uu); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !hasWritePermission(loginsession, collection) {
+		writeError(w, errPermissionDenied(uu))
+		return
+	}
+
+	if req.Delete {
+		_, err = transform.DeleteTransform(ctx, etcdConn, uu)
+		if err != nil {
+			writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not remove transform: %v", err))
+			return
+		}
+		w.Write([]byte("Transform removed."))
+		return
+	}
+
+	var t = &transform.Transform{Offset: req.Offset, Unit: req.Unit}
+	if req.Scale != nil {
+		t.Scale = *req.Scale
+	} else {
+		ann, _, err := s.CachedAnnotations(ctx)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var ok bool
+		t.Scale, ok = transform.Conversion(ann[UNIT_ANNOTATION], req.Unit)
+		if !ok {
+			writeError(w, errBadRequest("Cannot convert from unit %q to unit %q; a scale is required", ann[UNIT_ANNOTATION], req.Unit))
+			return
+		}
+	}
+	if t.Scale == 0 {
+		writeError(w, errBadRequest("The scale of a transform must be nonzero"))
+		return
+	}
+
+	err = transform.UpsertTransform(ctx, etcdConn, uu, t)
+	if err != nil {
+		writeError(w, newPlotterError(http.StatusInternalServerError, ERRCODE_INTERNAL, "Could not store transform: %v", err))
+		return
+	}
+	w.Write([]byte("Transform updated."))
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright (C) 2017 Sam Kumar, Michael Andersen, and the University
+ * of California, Berkeley.
+ *
+ * This file is part of Mr. Plotter (the Multi-Resolution Plotter).
+ *
+ * Mr. Plotter is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Mr. Plotter is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Mr. Plotter.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/* This file contains the logic for paginated tree requests. Instead of a bare
+   path, a request to /treebranch or /treeleaf may give, after the token and
+   semicolon, a JSON document of the form {"Path": "...", "Cursor": "...",
+   "Limit": 100, "Children": false}. The response is then a TreePage holding
+   at most Limit results, and a Cursor to pass in the next request, which is
+   empty on the last page.
+
+   If Children is true, /treebranch returns only the immediate children of
+   Path (the top level of the tree if Path is empty): both the collections
+   and the streams directly below it, each with the number of its own
+   children, so that the tree can be expanded one level at a time. */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/BTrDB/btrdb.v4"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
+
+const TREE_DEFAULT_LIMIT = 1000
+const TREE_MAX_LIMIT = 10000
+
+// TreeRequest is a request for a page of the stream tree.
+type TreeRequest struct {
+	Path     string
+	Cursor   string
+	Limit    int
+	Children bool
+}
+
+// TreeNode is a child in the stream tree. Children is the number of its own
+// children, which is always 0 for a stream.
+type TreeNode struct {
+	Path     string
+	Leaf     bool
+	Children int
+}
+
+// TreePage is a page of a response to a TreeRequest. Paths is set for a
+// request with Children false, and Nodes otherwise; the other is null.
+type TreePage struct {
+	Paths  []string
+	Nodes  []TreeNode
+	Cursor string
+}
+
+/* Checks if the request after the token is a TreeRequest rather than a bare
+   path, and parses it if so. */
+func parseTreeRequest(request string) (*TreeRequest, bool, error) {
+	if !strings.HasPrefix(request, "{") {
+		return nil, false, nil
+	}
+	var req TreeRequest
+	if err := json.Unmarshal([]byte(request), &req); err != nil {
+		return nil, true, errBadRequest("Received invalid JSON: %v", err)
+	}
+	if req.Limit == 0 {
+		req.Limit = TREE_DEFAULT_LIMIT
+	} else if req.Limit < 0 || req.Limit > TREE_MAX_LIMIT {
+		return nil, true, errBadRequest("Limit must be between 1 and %d", TREE_MAX_LIMIT)
+	}
+	return &req, true, nil
+}
+
+/* Returns the index of the first key after the cursor in the sorted slice of
+   KEYS, and the cursor for the page of at most LIMIT keys starting there.
+   Several streams may have the same path, so a cursor holds the last key
+   returned and the number of keys equal to it that have been returned. */
+func treePageBounds(keys []string, cursor string, limit int) (int, int, string, error) {
+	var start = 0
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return 0, 0, "", errBadRequest("Invalid cursor %s", cursor)
+		}
+		sep := strings.IndexByte(string(decoded), ':')
+		if sep == -1 {
+			return 0, 0, "", errBadRequest("Invalid cursor %s", cursor)
+		}
+		skip, err := strconv.Atoi(string(decoded[:sep]))
+		if err != nil || skip <= 0 {
+			return 0, 0, "", errBadRequest("Invalid cursor %s", cursor)
+		}
+		after := string(decoded[sep+1:])
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] >= after })
+		for ; skip != 0 && start != len(keys) && keys[start] == after; skip-- {
+			start++
+		}
+	}
+	var end = start + limit
+	if end >= len(keys) {
+		return start, len(keys), "", nil
+	}
+	var last = keys[end-1]
+	var returned = 1
+	for i := end - 2; i >= 0 && keys[i] == last; i-- {
+		returned++
+	}
+	next := strconv.Itoa(returned) + ":" + last
+	return start, end, base64.RawURLEncoding.EncodeToString([]byte(next)), nil
+}
+
+func paginatePaths(paths []string, req *TreeRequest) (*TreePage, error) {
+	start, end, next, err := treePageBounds(paths, req.Cursor, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return &TreePage{Paths: paths[start:end], Cursor: next}, nil
+}
+
+/* Checks if the user may see the collection. */
+func collectionVisible(coll string, prefixes map[string]struct{}) bool {
+	for pfx := range prefixes {
+		if strings.HasPrefix(coll, pfx) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Returns the name of the child of the collection prefix PREFIX that contains
+   the collection COLL, which must begin with PREFIX. */
+func childCollection(prefix string, coll string) string {
+	var rest = coll[len(prefix):]
+	/* As in treetopPaths, a leading separator is part of the first name. */
+	if sep := strings.IndexByte(rest, btrdbSeparator); sep > 0 {
+		return prefix + rest[:sep]
+	} else if sep == 0 {
+		if sep = strings.IndexByte(rest[1:], btrdbSeparator); sep != -1 {
+			return prefix + rest[:sep+1]
+		}
+	}
+	return coll
+}
+
+/* Returns the immediate children of the collection at PATH in the stream tree,
+   with the number of children of each, sorted by path. */
+func treeChildren(ctx context.Context, ec *etcd.Client, bc *btrdb.BTrDB, ls *LoginSession, req *TreeRequest) (*TreePage, error) {
+	prefixes, err := getprefixes(ctx, ec, ls)
+	if err != nil {
+		return nil, err
+	}
+
+	var coll = strings.Replace(req.Path, string(plotterSeparator), string(btrdbSeparator), -1)
+	var collprefix = coll
+	if coll != "" {
+		collprefix += string(btrdbSeparator)
+	}
+	collections, err := listCollections(ctx, bc, collprefix)
+	if err != nil {
+		return nil, err
+	}
+
+	/* The visible collections below PATH, grouped by the child of PATH that
+	   contains them. */
+	var descendants = make(map[string][]string)
+	for _, c := range collections {
+		if collectionVisible(c, prefixes) {
+			child := childCollection(collprefix, c)
+			descendants[child] = append(descendants[child], c)
+		}
+	}
+
+	var leaves []string
+	if coll != "" && collectionVisible(coll, prefixes) {
+		leaves, err = listLeafNames(ctx, bc, coll)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var topath = func(c string) string {
+		return strings.Replace(c, string(btrdbSeparator), string(plotterSeparator), -1)
+	}
+	var nodes = make([]TreeNode, 0, len(descendants)+len(leaves))
+	for child := range descendants {
+		nodes = append(nodes, TreeNode{Path: topath(child)})
+	}
+	for _, leafname := range leaves {
+		nodes = append(nodes, TreeNode{Path: topath(coll) + string(plotterSeparator) + leafname, Leaf: true})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Path < nodes[j].Path })
+
+	var keys = make([]string, len(nodes))
+	for i := range nodes {
+		keys[i] = nodes[i].Path
+	}
+	start, end, next, err := treePageBounds(keys, req.Cursor, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	nodes = nodes[start:end]
+
+	/* Count the children only for the collections on this page, since
+	   counting streams may require a query. */
+	for i := range nodes {
+		if nodes[i].Leaf {
+			continue
+		}
+		child := strings.Replace(nodes[i].Path, string(plotterSeparator), string(btrdbSeparator), -1)
+		grandchildren := make(map[string]struct{})
+		hasStreams := false
+		for _, c := range descendants[child] {
+			if c == child {
+				hasStreams = true
+			} else if strings.HasPrefix(c, child+string(btrdbSeparator)) {
+				grandchildren[childCollection(child+string(btrdbSeparator), c)] = struct{}{}
+			}
+		}
+		nodes[i].Children = len(grandchildren)
+		if hasStreams {
+			childleaves, err := listLeafNames(ctx, bc, child)
+			if err != nil {
+				return nil, err
+			}
+			nodes[i].Children += len(childleaves)
+		}
+	}
+
+	return &TreePage{Nodes: nodes, Cursor: next}, nil
+}